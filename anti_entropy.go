@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/ZainAli104/distributed-file-system-go/p2p"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	defaultAntiEntropyInterval = 10 * time.Second
+
+	// merkleDepth is the depth of the Merkle trees, which have a leaf for
+	// every value of the first byte of the hash of an entry.
+	merkleDepth = 8
+)
+
+// merkleTree is a binary hash tree over the entries of the store. The entries
+// are spread over the leaves by their hash, so two trees over almost the same
+// entries only differ in the few paths that lead to the leaves with the
+// entries that differ.
+type merkleTree struct {
+	// levels holds the hashes of the nodes, from the root at level 0 down to
+	// the leaves at level merkleDepth.
+	levels  [merkleDepth + 1][][]byte
+	buckets [1 << merkleDepth][]StoreEntry
+}
+
+func entryBucket(id string, key string) int {
+	hash := sha256.Sum256([]byte(id + key))
+	return int(hash[0])
+}
+
+func newMerkleTree(entries []StoreEntry) *merkleTree {
+	t := &merkleTree{}
+	for _, e := range entries {
+		i := entryBucket(e.ID, e.Key)
+		t.buckets[i] = append(t.buckets[i], e)
+	}
+
+	leaves := make([][]byte, len(t.buckets))
+	for i, bucket := range t.buckets {
+		sort.Slice(bucket, func(a, b int) bool {
+			if bucket[a].ID != bucket[b].ID {
+				return bucket[a].ID < bucket[b].ID
+			}
+			return bucket[a].Key < bucket[b].Key
+		})
+
+		hash := sha256.New()
+		for _, e := range bucket {
+			fmt.Fprintf(hash, "%s/%x/%d/%x/%t\n", e.ID, e.Key, e.Version, e.Checksum, e.Deleted)
+		}
+		leaves[i] = hash.Sum(nil)
+	}
+	t.levels[merkleDepth] = leaves
+
+	for level := merkleDepth - 1; level >= 0; level-- {
+		below := t.levels[level+1]
+		nodes := make([][]byte, len(below)/2)
+		for i := range nodes {
+			hash := sha256.New()
+			hash.Write(below[2*i])
+			hash.Write(below[2*i+1])
+			nodes[i] = hash.Sum(nil)
+		}
+		t.levels[level] = nodes
+	}
+
+	return t
+}
+
+// hashes returns the hashes of the nodes at the given level and indexes, of
+// which the ones that don't exist are nil.
+func (t *merkleTree) hashes(level int, indexes []int) [][]byte {
+	hashes := make([][]byte, len(indexes))
+	if level < 0 || level > merkleDepth {
+		return hashes
+	}
+	for j, i := range indexes {
+		if i >= 0 && i < len(t.levels[level]) {
+			hashes[j] = t.levels[level][i]
+		}
+	}
+	return hashes
+}
+
+// MessageSyncTree asks a peer for the hashes of the nodes at the given level
+// of its Merkle tree over the files we both own.
+type MessageSyncTree struct {
+	Level   int
+	Indexes []int
+}
+
+type MessageSyncTreeResponse struct {
+	Hashes [][]byte
+}
+
+// MessageSyncEntries asks a peer for the entries in the given leaves of its
+// Merkle tree over the files we both own.
+type MessageSyncEntries struct {
+	Buckets []int
+}
+
+type MessageSyncEntriesResponse struct {
+	Entries []StoreEntry
+}
+
+// sharedEntries returns the entries of the store of which both we and the
+// node with the given ID are owners.
+func (s *FileServer) sharedEntries(id string) ([]StoreEntry, error) {
+	entries, err := s.store.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	ring := s.ring()
+
+	var shared []StoreEntry
+	for _, e := range entries {
+		var ours, theirs bool
+		for _, owner := range ring.owners(e.Key, s.ReplicationFactor) {
+			ours = ours || owner.ID == s.ID
+			theirs = theirs || owner.ID == id
+		}
+		if ours && theirs {
+			shared = append(shared, e)
+		}
+	}
+	return shared, nil
+}
+
+// syncWith compares our Merkle tree over the files we share with the node
+// with the tree of the node, and fetches every file of which the node has a
+// newer version. Only the subtrees that differ are walked down, so nodes that
+// are in sync only trade their roots.
+func (s *FileServer) syncWith(node PeerInfo) error {
+	entries, err := s.sharedEntries(node.ID)
+	if err != nil {
+		return err
+	}
+	tree := newMerkleTree(entries)
+
+	indexes := []int{0}
+	for level := 0; level <= merkleDepth && len(indexes) > 0; level++ {
+		msg, err := s.call(node, MessageSyncTree{Level: level, Indexes: indexes})
+		if err != nil {
+			return err
+		}
+		v, ok := msg.Payload.(MessageSyncTreeResponse)
+		if !ok || len(v.Hashes) != len(indexes) {
+			return fmt.Errorf("unexpected response from %s: %T", node.ListenAddr, msg.Payload)
+		}
+
+		local := tree.hashes(level, indexes)
+
+		var differ []int
+		for j, i := range indexes {
+			if !bytes.Equal(local[j], v.Hashes[j]) {
+				differ = append(differ, i)
+			}
+		}
+
+		if level == merkleDepth {
+			indexes = differ
+			break
+		}
+
+		indexes = indexes[:0:0]
+		for _, i := range differ {
+			indexes = append(indexes, 2*i, 2*i+1)
+		}
+	}
+
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	msg, err := s.call(node, MessageSyncEntries{Buckets: indexes})
+	if err != nil {
+		return err
+	}
+	v, ok := msg.Payload.(MessageSyncEntriesResponse)
+	if !ok {
+		return fmt.Errorf("unexpected response from %s: %T", node.ListenAddr, msg.Payload)
+	}
+
+	local := make(map[string]FileMeta)
+	for _, i := range indexes {
+		for _, e := range tree.buckets[i] {
+			local[e.ID+e.Key] = e.FileMeta
+		}
+	}
+
+	// The node fetches the files of which we have the newest version
+	// itself, when it syncs with us.
+	for _, e := range v.Entries {
+		if meta, ok := local[e.ID+e.Key]; ok && meta.Version >= e.Version {
+			continue
+		}
+		if err := s.pullReplica(node, e); err != nil {
+			log.Printf("[%s] anti-entropy: failed to fetch (%x) from %s: %s\n", s.Transport.Addr(), e.Key, node.ListenAddr, err)
+		}
+	}
+
+	return nil
+}
+
+// pullReplica copies the replica of the entry from the node, or its tombstone.
+func (s *FileServer) pullReplica(node PeerInfo, e StoreEntry) error {
+	if e.Deleted {
+		return s.deleteReplica(e.ID, e.Key, e.Version)
+	}
+
+	peer, err := s.dialNode(node)
+	if err != nil {
+		return err
+	}
+
+	req := s.newRequest(1)
+	defer s.closeRequest(req)
+
+	msg := Message{
+		RequestID: req.id,
+		Payload: MessageGetFile{
+			ID:  e.ID,
+			Key: e.Key,
+		},
+	}
+	if s.requestPeers(req, []p2p.Peer{peer}, &msg) == 0 {
+		return fmt.Errorf("failed to send request to %s", node.ListenAddr)
+	}
+
+	resp, err := req.wait()
+	if err != nil {
+		return err
+	}
+	if resp.err != nil {
+		return resp.err
+	}
+
+	v, ok := resp.msg.Payload.(MessageGetFileResponse)
+	if !ok || !v.Found {
+		resp.discard()
+		return fmt.Errorf("file not found")
+	}
+
+	// Only the chunks we don't have are fetched.
+	missing, body, err := s.fetchMissing(resp.from, v.Chunks)
+	if err != nil {
+		return err
+	}
+	n, sum, err := s.store.WriteChunks(e.ID, e.Key, v.Chunks, missing, body)
+	body.Close()
+	if err == nil && n != v.Size {
+		err = fmt.Errorf("received %d of %d bytes", n, v.Size)
+	}
+	if err == nil && !bytes.Equal(sum, e.Checksum) {
+		err = fmt.Errorf("checksum mismatch")
+	}
+	if err != nil {
+		s.store.Delete(e.ID, e.Key)
+		return err
+	}
+
+	fmt.Printf("[%s] anti-entropy: fetched (%x) from %s\n", s.Transport.Addr(), e.Key, node.ListenAddr)
+
+	return s.store.WriteMeta(e.ID, e.Key, e.FileMeta)
+}
+
+// antiEntropy syncs with every node we are connected with.
+func (s *FileServer) antiEntropy() {
+	for _, node := range s.knownNodes() {
+		if err := s.syncWith(node); err != nil {
+			log.Printf("[%s] anti-entropy with %s failed: %s\n", s.Transport.Addr(), node.ListenAddr, err)
+		}
+	}
+}
+
+func (s *FileServer) antiEntropyLoop() {
+	ticker := time.NewTicker(s.AntiEntropyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.antiEntropy()
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// treeFor returns our Merkle tree over the files we share with the node
+// that is connected over the peer with the given address.
+func (s *FileServer) treeFor(from string) (*merkleTree, error) {
+	s.peerLock.Lock()
+	node, ok := s.nodes[from]
+	s.peerLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no hello received from %s", from)
+	}
+
+	entries, err := s.sharedEntries(node.ID)
+	if err != nil {
+		return nil, err
+	}
+	return newMerkleTree(entries), nil
+}
+
+func (s *FileServer) handleMessageSyncTree(from string, requestID uint64, msg MessageSyncTree) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer not found: %s", from)
+	}
+
+	tree, err := s.treeFor(from)
+	if err != nil {
+		return err
+	}
+
+	resp := Message{
+		RequestID: requestID,
+		Payload: MessageSyncTreeResponse{
+			Hashes: tree.hashes(msg.Level, msg.Indexes),
+		},
+	}
+	return s.send(peer, &resp)
+}
+
+func (s *FileServer) handleMessageSyncEntries(from string, requestID uint64, msg MessageSyncEntries) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer not found: %s", from)
+	}
+
+	tree, err := s.treeFor(from)
+	if err != nil {
+		return err
+	}
+
+	var entries []StoreEntry
+	for _, i := range msg.Buckets {
+		if i >= 0 && i < len(tree.buckets) {
+			entries = append(entries, tree.buckets[i]...)
+		}
+	}
+
+	resp := Message{
+		RequestID: requestID,
+		Payload:   MessageSyncEntriesResponse{Entries: entries},
+	}
+	return s.send(peer, &resp)
+}
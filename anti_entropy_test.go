@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestMerkleTree(t *testing.T) {
+	var entries []StoreEntry
+	for i := 0; i < 100; i++ {
+		entries = append(entries, StoreEntry{
+			ID:       "node",
+			Key:      hashKey(fmt.Sprintf("picture_%d.jpg", i)),
+			FileMeta: FileMeta{Version: int64(i)},
+		})
+	}
+
+	a := newMerkleTree(entries)
+	b := newMerkleTree(append([]StoreEntry{}, entries...))
+	if !bytes.Equal(a.levels[0][0], b.levels[0][0]) {
+		t.Fatal("expected trees over the same entries to have the same root")
+	}
+
+	changed := append([]StoreEntry{}, entries...)
+	changed[42].Version++
+	c := newMerkleTree(changed)
+	if bytes.Equal(a.levels[0][0], c.levels[0][0]) {
+		t.Fatal("expected trees over different entries to have different roots")
+	}
+
+	// Only the path to the leaf of the changed entry differs.
+	leaf := entryBucket(changed[42].ID, changed[42].Key)
+	for level := merkleDepth; level >= 0; level-- {
+		for i := range a.levels[level] {
+			differ := !bytes.Equal(a.levels[level][i], c.levels[level][i])
+			if differ != (i == leaf>>(merkleDepth-level)) {
+				t.Errorf("level %d node %d: expected it to differ %t, got %t", level, i, !differ, differ)
+			}
+		}
+	}
+
+	if hashes := a.hashes(merkleDepth+1, []int{0}); hashes[0] != nil {
+		t.Errorf("expected no hash below the leaves, got %x", hashes[0])
+	}
+}
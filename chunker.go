@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// The sizes of the chunks the chunker cuts, the chunks are around
+// avgChunkSize bytes.
+const (
+	minChunkSize = 2 << 10  // 2KB
+	avgChunkSize = 8 << 10  // 8KB
+	maxChunkSize = 64 << 10 // 64KB
+)
+
+// The masks of FastCDC with normalized chunking for 8KB chunks. The first
+// one makes a cut before the avgChunkSize less likely, the second one makes
+// a cut after it more likely.
+const (
+	chunkMaskS = 0x0003590703530000
+	chunkMaskL = 0x0000d90003530000
+)
+
+// gear holds a random number for every byte. It is derived from the byte
+// itself, so every node cuts the same content in the same chunks.
+var gear [256]uint64
+
+func init() {
+	for i := range gear {
+		hash := sha256.Sum256([]byte{byte(i)})
+		gear[i] = binary.BigEndian.Uint64(hash[:8])
+	}
+}
+
+// cutPoint returns the length of the first chunk of data with FastCDC. Where
+// a chunk ends only depends on the bytes around it, so content that is the
+// same across files and versions ends up in the same chunks.
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= minChunkSize {
+		return n
+	}
+	if n > maxChunkSize {
+		n = maxChunkSize
+	}
+	normal := min(n, avgChunkSize)
+
+	var (
+		fp uint64
+		i  = minChunkSize
+	)
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&chunkMaskS == 0 {
+			return i
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&chunkMaskL == 0 {
+			return i
+		}
+	}
+	return n
+}
+
+// chunker cuts everything that is read from r into content-defined chunks.
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	// start and end are the bytes in buf that are not returned yet.
+	start, end int
+	err        error
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: r, buf: make([]byte, maxChunkSize)}
+}
+
+// next returns the next chunk, or io.EOF once everything was read. The chunk
+// is only valid until the next call.
+func (c *chunker) next() ([]byte, error) {
+	if c.end-c.start < maxChunkSize && c.err == nil {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+
+		var n int
+		n, c.err = io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		if c.err == io.ErrUnexpectedEOF {
+			c.err = io.EOF
+		}
+	}
+
+	if c.start == c.end {
+		if c.err == nil {
+			c.err = io.EOF
+		}
+		return nil, c.err
+	}
+	if c.err != nil && c.err != io.EOF {
+		return nil, c.err
+	}
+
+	n := cutPoint(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// chunkAll cuts data in chunks, and returns them as strings.
+func chunkAll(t *testing.T, data []byte) []string {
+	var (
+		chunks  []string
+		chunker = newChunker(bytes.NewReader(data))
+	)
+	for {
+		chunk, err := chunker.next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, string(chunk))
+	}
+}
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := chunkAll(t, data)
+	var joined []byte
+	for i, chunk := range chunks {
+		if len(chunk) > maxChunkSize || (len(chunk) < minChunkSize && i < len(chunks)-1) {
+			t.Errorf("chunk %d has %d bytes", i, len(chunk))
+		}
+		joined = append(joined, chunk...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatal("expected the chunks to add up to the data")
+	}
+	if n := len(chunks); n < len(data)/maxChunkSize || n > len(data)/minChunkSize {
+		t.Errorf("expected around %d chunks, got %d", len(data)/avgChunkSize, n)
+	}
+
+	// Inserting a few bytes only changes the chunks around them.
+	edited := append(append(append([]byte{}, data[:len(data)/2]...), "foo"...), data[len(data)/2:]...)
+	seen := make(map[string]bool)
+	for _, chunk := range chunks {
+		seen[chunk] = true
+	}
+	changed := 0
+	for _, chunk := range chunkAll(t, edited) {
+		if !seen[chunk] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("expected at most 2 changed chunks, got %d", changed)
+	}
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"fmt"
+	"hash"
 	"io"
 )
 
@@ -26,64 +32,190 @@ func newEncryptionKey() []byte {
 	return keyBuf
 }
 
-func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Writer) (int, error) {
+// The content is encrypted chunk by chunk, every chunk with an IV that is
+// derived from the chunk itself. The same chunk is encrypted to the same
+// bytes, also in other files and versions, so the chunks of the encrypted
+// content deduplicate just as well as the chunks of the plain content. The
+// last four bytes of the IV hold the length of the chunk, and every encrypted
+// chunk is followed by a tag that authenticates the IV and the encrypted
+// chunk, so a chunk that was changed is never decrypted.
+//
+// The tag of a chunk doesn't depend on where the chunk is, or the chunks would
+// no longer deduplicate once one is inserted in front of them. The order of
+// the chunks is authenticated by the end of the content instead: an empty
+// chunk whose tag authenticates the tags of all chunks before it, in order.
+// Chunks that are swapped, repeated, left out or cut off fail there, which is
+// after they were decrypted, so whoever reads the plain content has to throw
+// it away when copyDecrypt fails.
+//
+// This is convergent encryption, and it comes with a trade-off. The nodes that
+// store the encrypted chunks can tell, without the key, which files and
+// versions share a chunk, and whoever has the key can confirm that a file
+// holds a chunk they guess. Since a chunk is stored under the hash of its
+// encrypted bytes, any node that has a chunk answers a MessageHaveChunks for
+// it, whichever file it came from. That is what the tag is for: a chunk is
+// only trusted when it authenticates, not because of who sent it.
+
+// chunkTagSize is the size of the tag that follows every encrypted chunk.
+const chunkTagSize = 16
+
+// endIV is the IV of the empty chunk at the end of the content.
+var endIV = make([]byte, aes.BlockSize)
+
+// chunkKeys are the keys that are derived from the encryption key, one for
+// every use of it.
+type chunkKeys struct {
+	iv    []byte
+	block cipher.Block
+	tag   []byte
+	end   []byte
+}
+
+func newChunkKeys(key []byte) (chunkKeys, error) {
+	block, err := aes.NewCipher(deriveKey(key, "chunk encryption"))
+	if err != nil {
+		return chunkKeys{}, err
+	}
+
+	return chunkKeys{
+		iv:    deriveKey(key, "chunk iv"),
+		block: block,
+		tag:   deriveKey(key, "chunk tag"),
+		end:   deriveKey(key, "end tag"),
+	}, nil
+}
+
+func deriveKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// chunkIV returns the IV of the chunk.
+func (k chunkKeys) chunkIV(chunk []byte) []byte {
+	mac := hmac.New(sha256.New, k.iv)
+	mac.Write(chunk)
+
+	iv := mac.Sum(nil)[:aes.BlockSize]
+	binary.BigEndian.PutUint32(iv[aes.BlockSize-4:], uint32(len(chunk)))
+	return iv
+}
+
+// chunkTag returns the tag of the encrypted chunk.
+func (k chunkKeys) chunkTag(iv []byte, encrypted []byte) []byte {
+	mac := hmac.New(sha256.New, k.tag)
+	mac.Write(iv)
+	mac.Write(encrypted)
+	return mac.Sum(nil)[:chunkTagSize]
+}
+
+// endTag returns the hash that the tags of the chunks are written to, in
+// order, and that sums up to the tag of the end of the content.
+func (k chunkKeys) endTag() hash.Hash {
+	return hmac.New(sha256.New, k.end)
+}
+
+// copyDecrypt decrypts everything copyEncrypt wrote to src, and returns the
+// number of encrypted bytes it read. It fails when the content doesn't end
+// like copyEncrypt ended it, and what it wrote to dst then is not to be used.
+func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	keys, err := newChunkKeys(key)
+	if err != nil {
+		return 0, err
+	}
+
 	var (
-		buf = make([]byte, 32*1024)
-		nw  = blockSize
+		iv     = make([]byte, aes.BlockSize)
+		buf    = make([]byte, maxChunkSize+chunkTagSize)
+		endTag = keys.endTag()
+		nw     = 0
 	)
 	for {
-		n, err := src.Read(buf)
-		if n > 0 {
-			stream.XORKeyStream(buf, buf[:n])
-			nn, err := dst.Write(buf[:n])
-			if err != nil {
-				return 0, err
+		if _, err := io.ReadFull(src, iv); err == io.EOF {
+			return 0, fmt.Errorf("content ends without its end: %w", io.ErrUnexpectedEOF)
+		} else if err != nil {
+			return 0, err
+		}
+
+		size := binary.BigEndian.Uint32(iv[len(iv)-4:])
+		if size > maxChunkSize {
+			return 0, fmt.Errorf("chunk of %d bytes is too large", size)
+		}
+		chunk, tag := buf[:size], buf[size:size+chunkTagSize]
+		if _, err := io.ReadFull(src, buf[:size+chunkTagSize]); err != nil {
+			return 0, err
+		}
+		nw += len(iv) + len(chunk) + len(tag)
+
+		if size == 0 {
+			if !bytes.Equal(iv, endIV) || !hmac.Equal(tag, endTag.Sum(nil)[:chunkTagSize]) {
+				return 0, fmt.Errorf("the chunks of the content failed authentication")
+			}
+			if n, _ := io.ReadFull(src, buf[:1]); n > 0 {
+				return 0, fmt.Errorf("content continues after its end")
 			}
-			nw += nn
+			return nw, nil
 		}
-		if err == io.EOF {
-			break
+
+		if !hmac.Equal(tag, keys.chunkTag(iv, chunk)) {
+			return 0, fmt.Errorf("chunk of %d bytes failed authentication", size)
 		}
-		if err != nil {
+		endTag.Write(tag)
+
+		cipher.NewCTR(keys.block, iv).XORKeyStream(chunk, chunk)
+		if _, err := dst.Write(chunk); err != nil {
 			return 0, err
 		}
 	}
-	return nw, nil
 }
 
-func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
+// copyEncrypt encrypts everything that is read from src, and returns the number
+// of encrypted bytes it wrote.
+func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	keys, err := newChunkKeys(key)
 	if err != nil {
 		return 0, err
 	}
 
-	// Read the IV from the given io.Reader(src) which, in our case
-	// should be the block.BlockSize() bytes we read.
-	iv := make([]byte, block.BlockSize())
-	if _, err := src.Read(iv); err != nil {
-		return 0, err
-	}
+	var (
+		chunker = newChunker(src)
+		buf     = make([]byte, maxChunkSize)
+		endTag  = keys.endTag()
+		nw      = 0
+	)
+	for {
+		chunk, err := chunker.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
 
-	stream := cipher.NewCTR(block, iv)
-	return copyStream(stream, block.BlockSize(), src, dst)
-}
+		iv := keys.chunkIV(chunk)
+		if _, err := dst.Write(iv); err != nil {
+			return 0, err
+		}
 
-func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return 0, err
+		encrypted := buf[:len(chunk)]
+		cipher.NewCTR(keys.block, iv).XORKeyStream(encrypted, chunk)
+		if _, err := dst.Write(encrypted); err != nil {
+			return 0, err
+		}
+
+		tag := keys.chunkTag(iv, encrypted)
+		if _, err := dst.Write(tag); err != nil {
+			return 0, err
+		}
+		endTag.Write(tag)
+		nw += len(iv) + len(encrypted) + len(tag)
 	}
 
-	iv := make([]byte, block.BlockSize()) // 16 bytes
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	if _, err := dst.Write(endIV); err != nil {
 		return 0, err
 	}
-
-	// prepend the IV to the encrypted file
-	if _, err := dst.Write(iv); err != nil {
+	if _, err := dst.Write(endTag.Sum(nil)[:chunkTagSize]); err != nil {
 		return 0, err
 	}
-
-	stream := cipher.NewCTR(block, iv)
-	return copyStream(stream, block.BlockSize(), src, dst)
+	return nw + len(endIV) + chunkTagSize, nil
 }
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"math/rand"
 	"testing"
 )
 
@@ -25,7 +28,8 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 		t.Error(err)
 	}
 
-	if nw != 16+len(payload) {
+	// One chunk, and the end of the content.
+	if nw != 16+len(payload)+chunkTagSize+16+chunkTagSize {
 		t.Fail()
 	}
 
@@ -33,3 +37,146 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 		t.Errorf("expected %s, got %s", string(payload), out.String())
 	}
 }
+
+func TestCopyDecryptRejectsChangedChunk(t *testing.T) {
+	key := newEncryptionKey()
+	encrypted := new(bytes.Buffer)
+	if _, err := copyEncrypt(key, bytes.NewReader([]byte("Foo not Bar")), encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a bit of the IV, of the encrypted chunk and of the tag.
+	for _, i := range []int{0, 16, 16 + len("Foo not Bar") + chunkTagSize - 1} {
+		changed := bytes.Clone(encrypted.Bytes())
+		changed[i] ^= 1
+
+		out := new(bytes.Buffer)
+		if _, err := copyDecrypt(key, bytes.NewReader(changed), out); err == nil {
+			t.Errorf("%d: expected the changed chunk to be rejected", i)
+		}
+		if out.Len() > 0 {
+			t.Errorf("%d: expected nothing to be decrypted, got %q", i, out.Bytes())
+		}
+	}
+}
+
+func TestCopyDecryptRejectsChangedOrder(t *testing.T) {
+	key := newEncryptionKey()
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	encrypted := new(bytes.Buffer)
+	if _, err := copyEncrypt(key, bytes.NewReader(data), encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	// Split the encrypted content in its chunks, of which the last one is the
+	// end of the content.
+	var chunks [][]byte
+	for b := encrypted.Bytes(); len(b) > 0; {
+		size := int(binary.BigEndian.Uint32(b[12:16]))
+		chunks = append(chunks, b[:16+size+chunkTagSize])
+		b = b[16+size+chunkTagSize:]
+	}
+	if len(chunks) < 4 {
+		t.Fatalf("expected at least 3 chunks and the end, got %d", len(chunks))
+	}
+	end := len(chunks) - 1
+
+	join := func(chunks ...[]byte) []byte {
+		return bytes.Join(chunks, nil)
+	}
+	tests := map[string][]byte{
+		"swapped":   join(append([][]byte{chunks[1], chunks[0]}, chunks[2:]...)...),
+		"repeated":  join(append([][]byte{chunks[0]}, chunks...)...),
+		"left out":  join(append([][]byte{chunks[0]}, chunks[2:]...)...),
+		"cut off":   join(append(chunks[:end-1:end-1], chunks[end])...),
+		"no end":    join(chunks[:end]...),
+		"after end": join(append(chunks[:len(chunks):len(chunks)], chunks[0])...),
+	}
+	for name, changed := range tests {
+		if _, err := copyDecrypt(key, bytes.NewReader(changed), io.Discard); err == nil {
+			t.Errorf("%s: expected the content to be rejected", name)
+		}
+	}
+
+	out := new(bytes.Buffer)
+	if _, err := copyDecrypt(key, bytes.NewReader(join(chunks...)), out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Error("expected the content to be decrypted")
+	}
+}
+
+func TestCopyDecryptRejectsChangedEnd(t *testing.T) {
+	key := newEncryptionKey()
+	encrypted := new(bytes.Buffer)
+	if _, err := copyEncrypt(key, bytes.NewReader([]byte("Foo not Bar")), encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a bit of the IV and of the tag of the end.
+	for _, i := range []int{encrypted.Len() - 16 - chunkTagSize, encrypted.Len() - 1} {
+		changed := bytes.Clone(encrypted.Bytes())
+		changed[i] ^= 1
+
+		if _, err := copyDecrypt(key, bytes.NewReader(changed), io.Discard); err == nil {
+			t.Errorf("%d: expected the changed end to be rejected", i)
+		}
+	}
+}
+
+func TestCopyEncryptDecryptEmpty(t *testing.T) {
+	key := newEncryptionKey()
+	encrypted := new(bytes.Buffer)
+	if _, err := copyEncrypt(key, bytes.NewReader(nil), encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	out := new(bytes.Buffer)
+	if _, err := copyDecrypt(key, bytes.NewReader(encrypted.Bytes()), out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() > 0 {
+		t.Errorf("expected nothing to be decrypted, got %q", out.Bytes())
+	}
+
+	// Without its end, empty content is no content at all.
+	if _, err := copyDecrypt(key, bytes.NewReader(nil), out); err == nil {
+		t.Error("expected content without its end to be rejected")
+	}
+}
+
+func TestCopyEncryptDeduplicates(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardownStore(t, s)
+
+	// Where the encrypted content is cut depends on the key, so the key is
+	// fixed like the data.
+	key := bytes.Repeat([]byte{1}, 32)
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	edited := append([]byte("foo"), data...)
+
+	// The encrypted versions of the file share nearly all of their chunks
+	// in the store, just like the plain versions would. Only the end of the
+	// content, which authenticates all of its chunks, always differs.
+	chunks := 0
+	for i, b := range [][]byte{data, edited} {
+		encrypted := new(bytes.Buffer)
+		if _, err := copyEncrypt(key, bytes.NewReader(b), encrypted); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Write(id, fmt.Sprintf("version_%d", i), encrypted); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			chunks = countChunks(t, s)
+		}
+	}
+	if n := countChunks(t, s); n > chunks+4 {
+		t.Errorf("expected at most %d chunks, got %d", chunks+4, n)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var errFileDeleted = errors.New("file deleted")
+
+// MessageDeleteFile asks an owner to delete its replica of the file, and to
+// leave a tombstone with the Version of the delete behind.
+type MessageDeleteFile struct {
+	ID      string
+	Key     string
+	Version int64
+}
+
+type MessageDeleteFileAck struct {
+	Error string
+}
+
+// Delete removes the file from our disk and from the disks of its owners, of
+// which WriteQuorum have to acknowledge it.
+func (s *FileServer) Delete(key string) error {
+	if err := s.store.Delete(s.ID, key); err != nil {
+		return err
+	}
+
+	var (
+		version = time.Now().UnixNano()
+		owners  = s.Owners(key)
+		quorum  = min(s.WriteQuorum, len(owners))
+		acked   = 0
+		failed  = make(map[string]error)
+		remote  []PeerInfo
+	)
+	for _, owner := range owners {
+		if owner.ID != s.ID {
+			remote = append(remote, owner)
+			continue
+		}
+		// We own the key ourselves, so we leave a tombstone just like the
+		// other owners do.
+		if err := s.deleteReplica(s.ID, hashKey(key), version); err != nil {
+			log.Printf("[%s] failed to delete our replica of file (%s): %s\n", s.Transport.Addr(), key, err)
+			failed[owner.ListenAddr] = err
+		} else {
+			acked++
+		}
+	}
+
+	remote, dead := s.liveOwners(remote)
+	for _, owner := range dead {
+		failed[owner.ListenAddr] = errMemberDead
+	}
+
+	peers, errs := s.dialEach(remote)
+	req := s.newRequest(len(peers))
+	defer s.closeRequest(req)
+
+	msg := Message{
+		RequestID: req.id,
+		Payload: MessageDeleteFile{
+			ID:      s.ID,
+			Key:     hashKey(key),
+			Version: version,
+		},
+	}
+
+	replicas := make(map[string]PeerInfo)
+	for i, peer := range peers {
+		if errs[i] != nil {
+			failed[remote[i].ListenAddr] = errs[i]
+			continue
+		}
+
+		addr := peer.RemoteAddr().String()
+		if s.requestPeers(req, peers[i:i+1], &msg) == 0 {
+			failed[remote[i].ListenAddr] = fmt.Errorf("failed to send request to %s", addr)
+			continue
+		}
+		replicas[addr] = remote[i]
+	}
+
+	acked = s.awaitAcks(req, replicas, acked, quorum, failed, checkDeleteAck)
+	if acked < quorum {
+		return &WriteQuorumError{
+			Key:    key,
+			Acked:  acked,
+			Quorum: quorum,
+			Failed: failed,
+		}
+	}
+
+	return nil
+}
+
+func checkDeleteAck(resp response) error {
+	if resp.err != nil {
+		return resp.err
+	}
+
+	ack, ok := resp.msg.Payload.(MessageDeleteFileAck)
+	if !ok {
+		return fmt.Errorf("unexpected response: %T", resp.msg.Payload)
+	}
+	if len(ack.Error) > 0 {
+		return errors.New(ack.Error)
+	}
+	return nil
+}
+
+func (s *FileServer) handleMessageDeleteFile(from string, requestID uint64, msg MessageDeleteFile) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer not found: %s", from)
+	}
+
+	var ack MessageDeleteFileAck
+	if err := s.deleteReplica(msg.ID, msg.Key, msg.Version); err != nil {
+		ack.Error = err.Error()
+	} else {
+		log.Printf("%s deleted file (%x)\n", s.Transport.Addr(), msg.Key)
+	}
+
+	resp := Message{
+		RequestID: requestID,
+		Payload:   ack,
+	}
+	return s.send(peer, &resp)
+}
+
+// deleteReplica replaces the replica of the file with a tombstone, unless the
+// replica is newer than the delete.
+func (s *FileServer) deleteReplica(id string, key string, version int64) error {
+	meta, err := s.store.ReadMeta(id, key)
+	if err != nil {
+		return err
+	}
+	if meta.Version > version {
+		return fmt.Errorf("version %d is newer than the delete %d", meta.Version, version)
+	}
+
+	if err := s.store.Delete(id, key); err != nil {
+		return err
+	}
+	return s.store.WriteMeta(id, key, FileMeta{Version: version, Deleted: true})
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/ZainAli104/distributed-file-system-go/p2p"
+	"log"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// idBits is the size of the node IDs and the key IDs, and so the number
+	// of buckets in the routing table.
+	idBits = 256
+
+	defaultBucketSize        = 20
+	defaultLookupConcurrency = 3
+)
+
+// nodeID is a position in the 256-bit Kademlia keyspace, in which the
+// distance between two IDs is their XOR.
+type nodeID [idBits / 8]byte
+
+// newNodeID returns the nodeID of the ID of a node. The IDs made by
+// generateID are used as is, everything else is hashed into the keyspace.
+func newNodeID(id string) nodeID {
+	var n nodeID
+	if b, err := hex.DecodeString(id); err == nil && len(b) == len(n) {
+		copy(n[:], b)
+		return n
+	}
+	return sha256.Sum256([]byte(id))
+}
+
+// keyNodeID returns the position of a hashed file key in the keyspace.
+func keyNodeID(hashedKey string) nodeID {
+	return sha256.Sum256([]byte(hashedKey))
+}
+
+func (n nodeID) xor(o nodeID) nodeID {
+	var d nodeID
+	for i := range n {
+		d[i] = n[i] ^ o[i]
+	}
+	return d
+}
+
+// closer reports whether a is closer to the target than b.
+func (n nodeID) closer(a, b nodeID) bool {
+	da, db := n.xor(a), n.xor(b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// bucket returns the index of the bucket o belongs in, which is the index of
+// the highest bit in which o differs from n, or -1 if they are equal.
+func (n nodeID) bucket(o nodeID) int {
+	d := n.xor(o)
+	for i, b := range d {
+		if b != 0 {
+			return idBits - 1 - (i*8 + bits.LeadingZeros8(b))
+		}
+	}
+	return -1
+}
+
+// routingTable holds the contacts of a node in k-buckets. Every bucket is
+// ordered from the least to the most recently seen contact.
+type routingTable struct {
+	self nodeID
+	k    int
+
+	lock    sync.Mutex
+	buckets [idBits][]PeerInfo
+}
+
+func newRoutingTable(self string, k int) *routingTable {
+	return &routingTable{
+		self: newNodeID(self),
+		k:    k,
+	}
+}
+
+// update marks the contact as the most recently seen one of its bucket. When
+// the bucket is full, the contact is not added and the least recently seen
+// contact of the bucket is returned instead, so the caller can decide to
+// replace it.
+func (t *routingTable) update(c PeerInfo) (PeerInfo, bool) {
+	i := t.self.bucket(newNodeID(c.ID))
+	if i < 0 {
+		return PeerInfo{}, false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	bucket := t.buckets[i]
+	for j, old := range bucket {
+		if old.ID == c.ID {
+			bucket = append(bucket[:j], bucket[j+1:]...)
+			break
+		}
+	}
+
+	if len(bucket) >= t.k {
+		t.buckets[i] = bucket
+		return bucket[0], true
+	}
+
+	t.buckets[i] = append(bucket, c)
+	return PeerInfo{}, false
+}
+
+// replace swaps the contact old for c, if old is still in the table.
+func (t *routingTable) replace(old, c PeerInfo) {
+	if t.remove(old.ID) {
+		t.update(c)
+	}
+}
+
+// remove drops the contact with the given ID, and reports whether it was there.
+func (t *routingTable) remove(id string) bool {
+	i := t.self.bucket(newNodeID(id))
+	if i < 0 {
+		return false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for j, c := range t.buckets[i] {
+		if c.ID == id {
+			t.buckets[i] = append(t.buckets[i][:j], t.buckets[i][j+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// contacts returns every contact in the table.
+func (t *routingTable) contacts() []PeerInfo {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var contacts []PeerInfo
+	for _, bucket := range t.buckets {
+		contacts = append(contacts, bucket...)
+	}
+	return contacts
+}
+
+// closest returns at most n contacts, ordered by their distance to the target.
+func (t *routingTable) closest(target nodeID, n int) []PeerInfo {
+	contacts := t.contacts()
+	sortByDistance(target, contacts)
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+func sortByDistance(target nodeID, contacts []PeerInfo) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return target.closer(newNodeID(contacts[i].ID), newNodeID(contacts[j].ID))
+	})
+}
+
+// MessageFindNode asks a node for the contacts it knows closest to the target.
+type MessageFindNode struct {
+	Target nodeID
+}
+
+type MessageFindNodeResponse struct {
+	Nodes []PeerInfo
+}
+
+// MessageFindValue is a MessageFindNode for the position of a file, which is
+// answered with Found when the node has the file itself.
+type MessageFindValue struct {
+	ID  string
+	Key string
+}
+
+type MessageFindValueResponse struct {
+	Found bool
+	Nodes []PeerInfo
+}
+
+// seen updates the routing table with a node that we just heard from. When its
+// bucket is full, the least recently seen contact makes room for it if we lost
+// the connection with that contact.
+func (s *FileServer) seen(c PeerInfo) {
+	old, full := s.routes.update(c)
+	if !full {
+		return
+	}
+	if _, ok := s.nodePeer(old.ID); !ok {
+		s.routes.replace(old, c)
+	}
+}
+
+// nodePeer returns the peer of the connection with the node with the given ID.
+func (s *FileServer) nodePeer(id string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	for addr, node := range s.nodes {
+		if node.ID == id {
+			return s.peers[addr], true
+		}
+	}
+	return nil, false
+}
+
+// dialNode returns the peer of the connection with the node, which is dialed
+// first if we are not connected with it yet.
+func (s *FileServer) dialNode(c PeerInfo) (p2p.Peer, error) {
+	// Start waiting on the hello before looking for the peer, so we can't miss it.
+	hello := s.waitHello(c.ID)
+	defer s.stopWaitingHello(c.ID, hello)
+
+	if peer, ok := s.nodePeer(c.ID); ok {
+		return peer, nil
+	}
+
+	if err := s.Transport.Dial(c.ListenAddr); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(s.RequestTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-hello:
+	case <-timer.C:
+		return nil, fmt.Errorf("dial node %s: %w", c.ListenAddr, errHelloTimeout)
+	case <-s.quitch:
+		return nil, fmt.Errorf("dial node %s: server stopped", c.ListenAddr)
+	}
+
+	if peer, ok := s.nodePeer(c.ID); ok {
+		return peer, nil
+	}
+	return nil, fmt.Errorf("dial node %s: connection dropped", c.ListenAddr)
+}
+
+// dialNodes returns the peers of the nodes, skipping the ones that can't be
+// reached.
+func (s *FileServer) dialNodes(nodes []PeerInfo) []p2p.Peer {
+	dialed, _ := s.dialEach(nodes)
+
+	peers := make([]p2p.Peer, 0, len(nodes))
+	for _, peer := range dialed {
+		if peer != nil {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// dialEach dials the nodes at the same time. The peers and the errors are
+// returned in the order of the nodes, for every node one of them is set.
+func (s *FileServer) dialEach(nodes []PeerInfo) ([]p2p.Peer, []error) {
+	var (
+		peers = make([]p2p.Peer, len(nodes))
+		errs  = make([]error, len(nodes))
+		wg    sync.WaitGroup
+	)
+	for i, c := range nodes {
+		wg.Add(1)
+		go func(i int, c PeerInfo) {
+			defer wg.Done()
+
+			peers[i], errs[i] = s.dialNode(c)
+			if errs[i] != nil {
+				log.Printf("[%s] failed to connect with %s: %s\n", s.Transport.Addr(), c.ListenAddr, errs[i])
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	return peers, errs
+}
+
+func (s *FileServer) waitHello(id string) chan struct{} {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	ch := make(chan struct{})
+	s.helloWaiters[id] = append(s.helloWaiters[id], ch)
+	return ch
+}
+
+func (s *FileServer) stopWaitingHello(id string, ch chan struct{}) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	waiters := s.helloWaiters[id]
+	for i, w := range waiters {
+		if w == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(s.helloWaiters, id)
+	} else {
+		s.helloWaiters[id] = waiters
+	}
+}
+
+// helloReceived wakes up everybody in dialNode that waits on the node.
+func (s *FileServer) helloReceived(id string) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	for _, ch := range s.helloWaiters[id] {
+		close(ch)
+	}
+	delete(s.helloWaiters, id)
+}
+
+// call sends a request to the node and waits for its response.
+func (s *FileServer) call(c PeerInfo, payload any) (*Message, error) {
+	peer, err := s.dialNode(c)
+	if err != nil {
+		return nil, err
+	}
+	return s.callPeer(peer, payload)
+}
+
+// callPeer sends the payload as a request to the peer, and waits on the response.
+func (s *FileServer) callPeer(peer p2p.Peer, payload any) (*Message, error) {
+	req := s.newRequest(1)
+	defer s.closeRequest(req)
+
+	msg := Message{
+		RequestID: req.id,
+		Payload:   payload,
+	}
+	if s.requestPeers(req, []p2p.Peer{peer}, &msg) == 0 {
+		return nil, fmt.Errorf("failed to send request to %s", peer.RemoteAddr())
+	}
+
+	resp, err := req.wait()
+	if err != nil {
+		return nil, err
+	}
+	if resp.err != nil {
+		return nil, resp.err
+	}
+	return resp.msg, nil
+}
+
+// lookup runs an iterative Kademlia lookup for the k nodes closest to the
+// target. With a MessageFindValue the lookup stops as soon as nodes respond
+// that they have the file, and those nodes are returned as well.
+func (s *FileServer) lookup(target nodeID, findValue *MessageFindValue) (closest []PeerInfo, found []PeerInfo) {
+	type result struct {
+		contact PeerInfo
+		nodes   []PeerInfo
+		found   bool
+		err     error
+	}
+
+	var (
+		shortlist = s.routes.closest(target, s.BucketSize)
+		seen      = make(map[string]bool)
+		queried   = make(map[string]bool)
+		responded = make(map[string]bool)
+	)
+	for _, c := range shortlist {
+		seen[c.ID] = true
+	}
+
+	for {
+		// Query the closest contacts we did not query yet, of the k closest
+		// ones that did not fail.
+		var round []PeerInfo
+		for _, c := range shortlist[:min(len(shortlist), s.BucketSize)] {
+			if !queried[c.ID] && len(round) < s.LookupConcurrency {
+				round = append(round, c)
+			}
+		}
+		if len(round) == 0 {
+			break
+		}
+
+		results := make(chan result, len(round))
+		for _, c := range round {
+			queried[c.ID] = true
+
+			go func(c PeerInfo) {
+				var payload any = MessageFindNode{Target: target}
+				if findValue != nil {
+					payload = *findValue
+				}
+
+				msg, err := s.call(c, payload)
+				if err != nil {
+					results <- result{contact: c, err: err}
+					return
+				}
+
+				switch v := msg.Payload.(type) {
+				case MessageFindNodeResponse:
+					results <- result{contact: c, nodes: v.Nodes}
+				case MessageFindValueResponse:
+					results <- result{contact: c, nodes: v.Nodes, found: v.Found}
+				default:
+					results <- result{contact: c, err: fmt.Errorf("unexpected response: %T", msg.Payload)}
+				}
+			}(c)
+		}
+
+		failed := make(map[string]bool)
+		for range round {
+			res := <-results
+			if res.err != nil {
+				// An unresponsive contact is stale, so it's dropped from the
+				// routing table as well.
+				fmt.Printf("[%s] lookup: %s did not respond: %s\n", s.Transport.Addr(), res.contact.ListenAddr, res.err)
+				s.routes.remove(res.contact.ID)
+				failed[res.contact.ID] = true
+				continue
+			}
+
+			responded[res.contact.ID] = true
+			if res.found {
+				found = append(found, res.contact)
+			}
+
+			for _, c := range res.nodes {
+				if c.ID == s.ID || seen[c.ID] {
+					continue
+				}
+				seen[c.ID] = true
+				shortlist = append(shortlist, c)
+			}
+		}
+
+		kept := shortlist[:0]
+		for _, c := range shortlist {
+			if !failed[c.ID] {
+				kept = append(kept, c)
+			}
+		}
+		shortlist = kept
+		sortByDistance(target, shortlist)
+
+		if len(found) > 0 {
+			break
+		}
+	}
+
+	for _, c := range shortlist {
+		if responded[c.ID] && len(closest) < s.BucketSize {
+			closest = append(closest, c)
+		}
+	}
+	return closest, found
+}
+
+func (s *FileServer) handleMessageFindNode(from string, requestID uint64, msg MessageFindNode) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer not found: %s", from)
+	}
+
+	resp := Message{
+		RequestID: requestID,
+		Payload: MessageFindNodeResponse{
+			Nodes: s.routes.closest(msg.Target, s.BucketSize),
+		},
+	}
+	return s.send(peer, &resp)
+}
+
+func (s *FileServer) handleMessageFindValue(from string, requestID uint64, msg MessageFindValue) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer not found: %s", from)
+	}
+
+	resp := Message{
+		RequestID: requestID,
+		Payload: MessageFindValueResponse{
+			Found: s.store.Has(msg.ID, msg.Key),
+			Nodes: s.routes.closest(keyNodeID(msg.Key), s.BucketSize),
+		},
+	}
+	return s.send(peer, &resp)
+}
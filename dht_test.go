@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func TestNodeIDBucket(t *testing.T) {
+	var a, b nodeID
+
+	if i := a.bucket(b); i != -1 {
+		t.Errorf("expected equal IDs to have no bucket, got %d", i)
+	}
+
+	b[len(b)-1] = 1
+	if i := a.bucket(b); i != 0 {
+		t.Errorf("expected bucket 0, got %d", i)
+	}
+
+	b[0] = 0x80
+	if i := a.bucket(b); i != idBits-1 {
+		t.Errorf("expected bucket %d, got %d", idBits-1, i)
+	}
+}
+
+func TestRoutingTable(t *testing.T) {
+	self := generateID()
+	table := newRoutingTable(self, 2)
+
+	var contacts []PeerInfo
+	for i := 0; i < 50; i++ {
+		c := PeerInfo{ID: generateID(), ListenAddr: fmt.Sprintf("node_%d", i)}
+		contacts = append(contacts, c)
+		table.update(c)
+	}
+
+	for i, bucket := range table.buckets {
+		if len(bucket) > 2 {
+			t.Errorf("bucket %d holds %d contacts", i, len(bucket))
+		}
+	}
+
+	// The closest contacts are ordered by their distance to the target.
+	target := newNodeID(generateID())
+	closest := table.closest(target, 5)
+	for i := 1; i < len(closest); i++ {
+		if target.closer(newNodeID(closest[i].ID), newNodeID(closest[i-1].ID)) {
+			t.Errorf("contact %d is closer to the target than contact %d", i, i-1)
+		}
+	}
+
+	// A full bucket hands back its least recently seen contact.
+	far := func(b byte) PeerInfo {
+		id := newNodeID(self)
+		id[0] ^= 0x80
+		id[len(id)-1] = b
+		return PeerInfo{ID: hex.EncodeToString(id[:])}
+	}
+
+	table = newRoutingTable(self, 2)
+	table.update(far(1))
+	table.update(far(2))
+	table.update(far(1))
+
+	old, full := table.update(far(3))
+	if !full || old.ID != far(2).ID {
+		t.Errorf("expected the full bucket to hand back %s, got %s (full: %v)", far(2).ID, old.ID, full)
+	}
+}
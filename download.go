@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ZainAli104/distributed-file-system-go/p2p"
+	"io"
+	"log"
+	"sync"
+)
+
+// downloadPieceSize is about the number of bytes of chunks that are asked for
+// at once. The pieces of a file are spread over the nodes that have it.
+const downloadPieceSize = 256 << 10 // 256KB
+
+// download fetches the chunks of a file from several nodes at once. Every
+// node takes the next piece once it is done with the previous one, so the
+// faster nodes serve more of the file. A piece that fails is handed to
+// another node, and once no piece is left to hand out, an idle node fetches a
+// piece that is still being fetched as well, so a slow node doesn't hold up
+// the end of the download.
+type download struct {
+	chunks []ChunkRef
+	// pieces holds the indexes of the chunks of every piece, by its id.
+	pieces [][]int
+
+	lock sync.Mutex
+	cond *sync.Cond
+	// pending holds the ids of the pieces no node is fetching.
+	pending []int
+	// fetchers holds the number of nodes that are fetching a piece, and
+	// streams the streams they fetch it over, by the id of the piece.
+	fetchers map[int]int
+	streams  map[int][]io.Closer
+	done     map[int]bool
+	// received holds the number of bytes received from every node, by the
+	// address of its peer. The chunks themselves are stored as they arrive.
+	received map[string]int64
+}
+
+// newDownload cuts the chunks at the indexes in pieces.
+func newDownload(chunks []ChunkRef, indexes []int) *download {
+	d := &download{
+		chunks:   chunks,
+		fetchers: make(map[int]int),
+		streams:  make(map[int][]io.Closer),
+		done:     make(map[int]bool),
+		received: make(map[string]int64),
+	}
+	d.cond = sync.NewCond(&d.lock)
+
+	var size int64
+	for _, i := range indexes {
+		if size == 0 {
+			d.pending = append(d.pending, len(d.pieces))
+			d.pieces = append(d.pieces, nil)
+		}
+		last := len(d.pieces) - 1
+		d.pieces[last] = append(d.pieces[last], i)
+
+		if size += chunks[i].Size; size >= downloadPieceSize {
+			size = 0
+		}
+	}
+	return d
+}
+
+// next returns the id of the piece to fetch next, and false once every piece
+// is done. It waits while every piece that is left is fetched by two nodes.
+func (d *download) next() (int, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for len(d.done) < len(d.pieces) {
+		if len(d.pending) > 0 {
+			id := d.pending[0]
+			d.pending = d.pending[1:]
+			d.fetchers[id]++
+			return id, true
+		}
+
+		// Help with the oldest piece that only one node is fetching, that
+		// node is the slowest.
+		slow := -1
+		for id, n := range d.fetchers {
+			if n == 1 && !d.done[id] && (slow < 0 || id < slow) {
+				slow = id
+			}
+		}
+		if slow >= 0 {
+			d.fetchers[slow]++
+			return slow, true
+		}
+
+		d.cond.Wait()
+	}
+	return 0, false
+}
+
+// started records the stream the piece is fetched over, so it can be closed
+// once another node fetched the piece. It returns false when that happened
+// already.
+func (d *download) started(id int, stream io.Closer) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.done[id] {
+		return false
+	}
+	d.streams[id] = append(d.streams[id], stream)
+	return true
+}
+
+// stopped forgets the node that fetched the piece over the stream. When no
+// node is fetching the piece anymore, and it isn't done, it is handed out
+// again.
+func (d *download) stopped(id int, stream io.Closer) {
+	streams := d.streams[id]
+	for i := range streams {
+		if streams[i] == stream {
+			d.streams[id] = append(streams[:i], streams[i+1:]...)
+			break
+		}
+	}
+
+	if d.fetchers[id]--; d.fetchers[id] == 0 {
+		delete(d.fetchers, id)
+		delete(d.streams, id)
+		if !d.done[id] {
+			d.pending = append(d.pending, id)
+		}
+	}
+	d.cond.Broadcast()
+}
+
+// fail stops the node from fetching the piece. It reports whether the node
+// failed, which it didn't when another node was first to fetch the piece, and
+// its stream was closed for that.
+func (d *download) fail(id int, stream io.Closer) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.stopped(id, stream)
+	return !d.done[id]
+}
+
+// finish marks the piece as done, unless another node was first, and stops
+// the other nodes that are fetching it.
+func (d *download) finish(id int, stream io.Closer, from string, received int64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if !d.done[id] {
+		d.done[id] = true
+		d.received[from] += received
+		for _, other := range d.streams[id] {
+			if other != stream {
+				other.Close()
+			}
+		}
+	}
+	d.stopped(id, stream)
+}
+
+// fetchFrom fetches pieces from the node on the other end of the peer until
+// none are left, or the node fails to send one.
+func (s *FileServer) fetchFrom(d *download, peer p2p.Peer) {
+	from := peer.RemoteAddr().String()
+	for {
+		id, ok := d.next()
+		if !ok {
+			return
+		}
+
+		var (
+			indexes  = d.pieces[id]
+			refs     = make([]ChunkRef, len(indexes))
+			sent     = make([]int, len(indexes))
+			received int64
+		)
+		for i, index := range indexes {
+			refs[i], sent[i] = d.chunks[index], i
+		}
+
+		body, err := s.fetchChunks(peer, d.chunks, indexes)
+		if err != nil {
+			d.fail(id, nil)
+			log.Printf("[%s] failed to fetch a piece from %s: %s\n", s.Transport.Addr(), from, err)
+			return
+		}
+		if !d.started(id, body) {
+			body.Close()
+			d.fail(id, nil)
+			continue
+		}
+
+		// Every chunk is verified against its hash as it is read, and
+		// stored right away, so the file is never held in memory.
+		err = s.store.ReadChunks(refs, sent, body, func(ref ChunkRef, chunk []byte) error {
+			received += int64(len(chunk))
+			_, err := s.store.WriteChunk(chunk)
+			return err
+		})
+		body.Close()
+
+		if err != nil {
+			if d.fail(id, body) {
+				log.Printf("[%s] failed to fetch a piece from %s: %s\n", s.Transport.Addr(), from, err)
+				return
+			}
+			continue
+		}
+		d.finish(id, body, from, received)
+	}
+}
+
+// downloadChunks fetches the chunks we don't have from the nodes on the other
+// end of the peers, which all have the file with the chunks, in parallel. The
+// chunks are in the store once it returns.
+func (s *FileServer) downloadChunks(peers []p2p.Peer, chunks []ChunkRef) (*download, error) {
+	d := newDownload(chunks, s.missingChunks(chunkHashes(chunks)))
+
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.fetchFrom(d, peer)
+		}()
+	}
+	wg.Wait()
+
+	if left := len(d.pieces) - len(d.done); left > 0 {
+		return nil, fmt.Errorf("failed to fetch %d of %d pieces from %d nodes", left, len(d.pieces), len(peers))
+	}
+	return d, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDownload(t *testing.T) {
+	chunks := make([]ChunkRef, 10)
+	indexes := make([]int, len(chunks))
+	for i := range chunks {
+		chunks[i] = ChunkRef{Hash: string(rune('a' + i)), Size: downloadPieceSize / 4}
+		indexes[i] = i
+	}
+
+	// The chunks are cut in pieces of downloadPieceSize bytes.
+	d := newDownload(chunks, indexes)
+	if len(d.pieces) != 3 || len(d.pieces[0]) != 4 || len(d.pieces[2]) != 2 {
+		t.Fatalf("expected pieces of 4, 4 and 2 chunks, got %v", d.pieces)
+	}
+
+	for i := range d.pieces {
+		if id, ok := d.next(); !ok || id != i {
+			t.Fatalf("expected piece %d, got %d", i, id)
+		}
+	}
+
+	// A piece that fails is handed out again.
+	if !d.fail(1, nil) {
+		t.Fatal("expected the piece to have failed")
+	}
+	if id, _ := d.next(); id != 1 {
+		t.Fatalf("expected piece 1 again, got %d", id)
+	}
+
+	// Once every piece is handed out, the pieces that are left are fetched
+	// by a second node, and the one that is last closes the stream of the
+	// other.
+	d.finish(1, nil, "a", 0)
+	if id, _ := d.next(); id != 0 {
+		t.Fatalf("expected piece 0 to be fetched twice, got %d", id)
+	}
+	slow := &closer{}
+	if !d.started(0, slow) {
+		t.Fatal("expected the piece not to be done")
+	}
+	d.finish(0, nil, "b", 0)
+	if !slow.closed {
+		t.Error("expected the stream of the slow node to be closed")
+	}
+	if d.fail(0, slow) {
+		t.Error("expected the piece to be done")
+	}
+
+	d.finish(2, nil, "a", 0)
+	if _, ok := d.next(); ok {
+		t.Error("expected every piece to be done")
+	}
+}
+
+type closer struct {
+	closed bool
+}
+
+func (c *closer) Close() error {
+	c.closed = true
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const defaultGarbageCollectInterval = 5 * time.Minute
+
+// garbageLoop removes the chunks of the files that were overwritten or
+// deleted, once they are not part of any other file anymore.
+func (s *FileServer) garbageLoop() {
+	ticker := time.NewTicker(s.GarbageCollectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n, err := s.store.CollectGarbage(s.GarbageCollectInterval)
+			if err != nil {
+				log.Printf("[%s] failed to collect the unused chunks: %s\n", s.Transport.Addr(), err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("[%s] removed %d unused chunks\n", s.Transport.Addr(), n)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
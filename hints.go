@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ZainAli104/distributed-file-system-go/p2p"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// hint is a replica that couldn't be written to its owner, which is kept by
+// the writer until the owner is back.
+type hint struct {
+	Owner PeerInfo
+	ID    string
+	Key   []byte
+	Meta  FileMeta
+}
+
+// hintStore keeps the hints on disk, in a directory per owner. Every hint is
+// a JSON file next to the encrypted content of the replica.
+type hintStore struct {
+	root string
+
+	lock sync.Mutex
+	// delivering holds the IDs of the owners of which the hints are being
+	// delivered, with the peer of the owner that connected since, if any.
+	delivering map[string]p2p.Peer
+}
+
+func newHintStore(root string) *hintStore {
+	return &hintStore{
+		root:       root,
+		delivering: make(map[string]p2p.Peer),
+	}
+}
+
+func (h *hintStore) path(owner string, id string, key []byte) string {
+	name := sha256.Sum256(append([]byte(id+"/"), key...))
+	return filepath.Join(h.root, owner, hex.EncodeToString(name[:]))
+}
+
+// add keeps the replica for the owner. A hint for an older version of the
+// same file is replaced.
+func (h *hintStore) add(hint hint, data []byte) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	path := h.path(hint.Owner.ID, hint.ID, hint.Key)
+	if old, err := readHint(path + ".hint"); err == nil && old.Meta.Version >= hint.Meta.Version {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".data", data, 0644); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(hint)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path+".hint", b, 0644)
+}
+
+func readHint(path string) (hint, error) {
+	var hint hint
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return hint, err
+	}
+	err = json.Unmarshal(b, &hint)
+	return hint, err
+}
+
+// list returns the hints for the owner.
+func (h *hintStore) list(owner string) ([]hint, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	files, err := os.ReadDir(filepath.Join(h.root, owner))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var hints []hint
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".hint") {
+			continue
+		}
+		hint, err := readHint(filepath.Join(h.root, owner, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		hints = append(hints, hint)
+	}
+	return hints, nil
+}
+
+// read returns the content of the replica of the hint.
+func (h *hintStore) read(hint hint) ([]byte, error) {
+	return os.ReadFile(h.path(hint.Owner.ID, hint.ID, hint.Key) + ".data")
+}
+
+// remove deletes the hint, unless it was replaced by a newer one.
+func (h *hintStore) remove(hint hint) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	path := h.path(hint.Owner.ID, hint.ID, hint.Key)
+	if current, err := readHint(path + ".hint"); err != nil || current.Meta.Version != hint.Meta.Version {
+		return nil
+	}
+
+	if err := os.Remove(path + ".hint"); err != nil {
+		return err
+	}
+	return os.Remove(path + ".data")
+}
+
+// startDelivery marks the hints of the owner as being delivered, and returns
+// false when they already are. The peer is then kept for when the delivery
+// that is going on fails, e.g. because its connection was a duplicate.
+func (h *hintStore) startDelivery(owner string, peer p2p.Peer) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if _, ok := h.delivering[owner]; ok {
+		h.delivering[owner] = peer
+		return false
+	}
+	h.delivering[owner] = nil
+	return true
+}
+
+// stopDelivery returns the peer the owner connected with since the delivery
+// started, which the hints are delivered over next. Without one, the hints
+// are no longer being delivered.
+func (h *hintStore) stopDelivery(owner string) p2p.Peer {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if peer := h.delivering[owner]; peer != nil {
+		h.delivering[owner] = nil
+		return peer
+	}
+	delete(h.delivering, owner)
+	return nil
+}
+
+// hintReplica keeps the replica the owner failed to store as a hint.
+func (s *FileServer) hintReplica(owner PeerInfo, msg MessageStoreFile, checksum []byte, data []byte) {
+	hint := hint{
+		Owner: owner,
+		ID:    msg.ID,
+		Key:   []byte(msg.Key),
+		Meta:  FileMeta{Version: msg.Version, Checksum: checksum},
+	}
+	if err := s.hints.add(hint, data); err != nil {
+		log.Printf("[%s] failed to keep a hint for %s: %s\n", s.Transport.Addr(), owner.ListenAddr, err)
+		return
+	}
+	fmt.Printf("[%s] keeping a hint of file (%x) for %s\n", s.Transport.Addr(), msg.Key, owner.ListenAddr)
+}
+
+// deliverHints writes the replicas we kept for the owner to it, now that it
+// is connected over the peer again. A hint is kept when the owner can't be
+// reached, and dropped once the owner answered, also when it refused the
+// replica because it has a newer version.
+func (s *FileServer) deliverHints(owner PeerInfo, peer p2p.Peer) {
+	if !s.hints.startDelivery(owner.ID, peer) {
+		return
+	}
+	for peer != nil {
+		s.deliverHintsOver(owner, peer)
+		peer = s.hints.stopDelivery(owner.ID)
+	}
+}
+
+// deliverHintsOver writes the hints of the owner over the peer, until one of
+// them fails to be delivered.
+func (s *FileServer) deliverHintsOver(owner PeerInfo, peer p2p.Peer) {
+	hints, err := s.hints.list(owner.ID)
+	if err != nil {
+		log.Printf("[%s] failed to read the hints for %s: %s\n", s.Transport.Addr(), owner.ListenAddr, err)
+		return
+	}
+
+	for _, hint := range hints {
+		data, err := s.hints.read(hint)
+		if err != nil {
+			log.Printf("[%s] failed to read the hint of file (%x): %s\n", s.Transport.Addr(), hint.Key, err)
+			continue
+		}
+
+		if _, err := s.pushReplica(peer, hint.ID, string(hint.Key), hint.Meta, chunkBytes(data), nil); err != nil {
+			log.Printf("[%s] failed to deliver the hint of file (%x) to %s: %s\n", s.Transport.Addr(), hint.Key, owner.ListenAddr, err)
+			if !errors.Is(err, errReplicaRefused) {
+				return
+			}
+		} else {
+			fmt.Printf("[%s] delivered the hint of file (%x) to %s\n", s.Transport.Addr(), hint.Key, owner.ListenAddr)
+		}
+
+		if err := s.hints.remove(hint); err != nil {
+			log.Printf("[%s] failed to remove the hint of file (%x): %s\n", s.Transport.Addr(), hint.Key, err)
+		}
+	}
+}
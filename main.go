@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
 	"fmt"
 	"github.com/ZainAli104/distributed-file-system-go/p2p"
 	"io"
@@ -11,10 +13,21 @@ import (
 )
 
 func makeServer(listenAddr string, nodes ...string) *FileServer {
+	_, identityKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	tcpTransportOpts := p2p.TCPTransportOpts{
-		ListenAddr:    listenAddr,
-		HandshakeFunc: p2p.NOPHandshakeFunc,
-		Decoder:       p2p.DefaultDecoder{},
+		ListenAddr: listenAddr,
+		HandshakeFunc: p2p.NewIdentityHandshakeFunc(p2p.IdentityHandshakeOpts{
+			PrivateKey: identityKey,
+		}),
+		Decoder:           p2p.DefaultDecoder{},
+		HeartbeatInterval: 5 * time.Second,
+		IdleTimeout:       15 * time.Second,
+		IOTimeout:         30 * time.Second,
+		AwaitAccept:       true,
 	}
 	tcpTransport := p2p.NewTCPTransport(tcpTransportOpts)
 
@@ -30,6 +43,7 @@ func makeServer(listenAddr string, nodes ...string) *FileServer {
 	s := NewFileServer(fileServerOpts)
 
 	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerDisconnect = s.OnPeerDisconnect
 
 	return s
 }
@@ -37,7 +51,8 @@ func makeServer(listenAddr string, nodes ...string) *FileServer {
 func main() {
 	s1 := makeServer(":3000", "")
 	s2 := makeServer(":4000", ":3000")
-	s3 := makeServer(":5000", ":3000", ":4000")
+	// s3 only knows about the seed, it finds s2 through peer exchange.
+	s3 := makeServer(":5000", ":3000")
 
 	go func() { log.Fatal(s1.Start()) }()
 	time.Sleep(1 * time.Second)
@@ -74,4 +89,12 @@ func main() {
 
 		log.Println(string(b))
 	}
+
+	// Deleting a file removes it from every node that has it.
+	if err := s3.Delete("picture_0.jpg"); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := s3.Get("picture_0.jpg"); err != nil {
+		log.Println(err)
+	}
 }
@@ -1,7 +1,9 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"io"
 )
 
@@ -9,35 +11,74 @@ type Decoder interface {
 	Decode(io.Reader, *RPC) error
 }
 
+type Encoder interface {
+	Encode(io.Writer, *Frame) error
+}
+
 type GOBDecoder struct{}
 
 func (g GOBDecoder) Decode(r io.Reader, msg *RPC) error {
 	return gob.NewDecoder(r).Decode(msg)
 }
 
+// DefaultEncoder writes a FrameHeader followed by the payload of the frame.
+type DefaultEncoder struct{}
+
+func (e DefaultEncoder) Encode(w io.Writer, f *Frame) error {
+	if len(f.Payload) > MaxFrameSize {
+		return fmt.Errorf("frame payload too large: %d bytes (max %d)", len(f.Payload), MaxFrameSize)
+	}
+
+	// The header and the payload are written with a single call, so two frames
+	// written to the same connection can never end up interleaved.
+	buf := make([]byte, FrameHeaderSize+len(f.Payload))
+	buf[0] = f.Kind
+	buf[1] = f.Flags
+	binary.BigEndian.PutUint32(buf[2:FrameHeaderSize], uint32(len(f.Payload)))
+	copy(buf[FrameHeaderSize:], f.Payload)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// DefaultDecoder reads the frames written by the DefaultEncoder.
 type DefaultDecoder struct{}
 
 func (g DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
-	peekBuf := make([]byte, 1)
-	if _, err := r.Read(peekBuf); err != nil {
-		return nil
+	header, err := ReadFrameHeader(r)
+	if err != nil {
+		return err
 	}
 
-	// In case of a stream we are not decoding what is being sent over the network.
-	// We are just setting the Stream flag to true so we can handle that in our logic.
-	stream := peekBuf[0] == IncomingStream
-	if stream {
-		msg.Stream = true
-		return nil
+	if header.Length > MaxFrameSize {
+		return fmt.Errorf("frame payload too large: %d bytes (max %d)", header.Length, MaxFrameSize)
 	}
 
-	buf := make([]byte, 1024)
-	n, err := r.Read(buf)
-	if err != nil {
+	payload := make([]byte, header.Length)
+	if _, err := io.ReadFull(r, payload); err != nil {
 		return err
 	}
 
-	msg.Payload = buf[:n]
+	// In case of a stream the payload is only the header of the stream, the body
+	// follows unframed. We are just setting the Stream flag to true so we can
+	// handle that in our logic.
+	msg.Stream = header.Kind == IncomingStream
+	msg.Kind = header.Kind
+	msg.Payload = payload
 
 	return nil
 }
+
+// ReadFrameHeader reads exactly FrameHeaderSize bytes from r and decodes them.
+func ReadFrameHeader(r io.Reader) (FrameHeader, error) {
+	var buf [FrameHeaderSize]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return FrameHeader{}, err
+	}
+
+	return FrameHeader{
+		Kind:   buf[0],
+		Flags:  buf[1],
+		Length: binary.BigEndian.Uint32(buf[2:]),
+	}, nil
+}
@@ -0,0 +1,52 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// chunkedReader returns at most n bytes per Read call, to simulate a message
+// that arrives split across multiple TCP segments.
+type chunkedReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *chunkedReader) Read(b []byte) (int, error) {
+	if len(b) > c.n {
+		b = b[:c.n]
+	}
+	return c.r.Read(b)
+}
+
+func TestDefaultEncoderDecoder(t *testing.T) {
+	large := bytes.Repeat([]byte("a"), 64*1024)
+	small := []byte("foo")
+
+	buf := new(bytes.Buffer)
+	enc := DefaultEncoder{}
+	assert.Nil(t, enc.Encode(buf, &Frame{Kind: IncomingMessage, Payload: large}))
+	assert.Nil(t, enc.Encode(buf, &Frame{Kind: IncomingMessage, Payload: small}))
+	assert.Nil(t, enc.Encode(buf, &Frame{Kind: IncomingStream, Payload: small}))
+
+	r := &chunkedReader{r: buf, n: 7}
+	dec := DefaultDecoder{}
+
+	rpc := RPC{}
+	assert.Nil(t, dec.Decode(r, &rpc))
+	assert.Equal(t, large, rpc.Payload)
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(r, &rpc))
+	assert.Equal(t, small, rpc.Payload)
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(r, &rpc))
+	assert.True(t, rpc.Stream)
+	assert.Equal(t, small, rpc.Payload)
+
+	assert.Equal(t, io.EOF, dec.Decode(r, &RPC{}))
+}
@@ -0,0 +1,277 @@
+package p2p
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reorderWindow is how long a write is held back at most.
+const reorderWindow = 10 * time.Millisecond
+
+type FaultOpts struct {
+	// Seed seeds the RNG which decides on every fault, so a failing
+	// run can be reproduced.
+	Seed int64
+	// Latency is added to every write, together with a random jitter
+	// of at most LatencyJitter.
+	Latency       time.Duration
+	LatencyJitter time.Duration
+	// DropAfterBytes closes the connection as soon as that many bytes have been
+	// written to it, and DropProbability is the chance that any write closes
+	// the connection instead. Both are disabled when zero.
+	DropAfterBytes  int64
+	DropProbability float64
+	// CorruptProbability is the chance that a random bit is flipped in a write.
+	CorruptProbability float64
+	// ReorderProbability is the chance that a write is held back and only
+	// sent after the write that comes after it.
+	ReorderProbability float64
+}
+
+// FaultInjector decorates connections, and the transports that create them,
+// with faults. Its WrapConn method can be used as the WrapConn hook of the
+// transports, so every peer of the transport goes through the injector.
+type FaultInjector struct {
+	FaultOpts
+
+	lock       sync.Mutex
+	rng        *rand.Rand
+	partitions map[string]int
+	conns      map[*faultConn]struct{}
+}
+
+func NewFaultInjector(opts FaultOpts) *FaultInjector {
+	return &FaultInjector{
+		FaultOpts:  opts,
+		rng:        rand.New(rand.NewSource(opts.Seed)),
+		partitions: make(map[string]int),
+		conns:      make(map[*faultConn]struct{}),
+	}
+}
+
+// WrapConn returns conn decorated with the faults of the injector.
+func (f *FaultInjector) WrapConn(conn net.Conn) net.Conn {
+	c := &faultConn{Conn: conn, injector: f}
+
+	f.lock.Lock()
+	f.conns[c] = struct{}{}
+	f.lock.Unlock()
+
+	return c
+}
+
+// Partition splits the network into the given groups of listen addresses.
+// Nodes in different groups can not talk to each other anymore, the
+// connections between them are closed and dials are refused. Addresses that
+// are not in any group can still talk to everybody.
+func (f *FaultInjector) Partition(groups ...[]string) {
+	f.lock.Lock()
+	f.partitions = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			f.partitions[addr] = i + 1
+		}
+	}
+
+	var conns []*faultConn
+	for c := range f.conns {
+		if f.partitioned(c.LocalAddr().String(), c.RemoteAddr().String()) {
+			conns = append(conns, c)
+		}
+	}
+	f.lock.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// nodeAddr strips the sequence number the MemNetwork adds to the address of
+// the dialing side of a connection, so it matches the listen address again.
+func nodeAddr(addr string) string {
+	if i := strings.LastIndexByte(addr, '#'); i >= 0 {
+		return addr[:i]
+	}
+	return addr
+}
+
+// Heal removes all partitions.
+func (f *FaultInjector) Heal() {
+	f.Partition()
+}
+
+// Partitioned reports whether the nodes at both addresses are in different partitions.
+func (f *FaultInjector) Partitioned(a, b string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.partitioned(a, b)
+}
+
+func (f *FaultInjector) partitioned(a, b string) bool {
+	ga, gb := f.partitions[nodeAddr(a)], f.partitions[nodeAddr(b)]
+	return ga != 0 && gb != 0 && ga != gb
+}
+
+func (f *FaultInjector) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.rng.Float64() < p
+}
+
+func (f *FaultInjector) intn(n int) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.rng.Intn(n)
+}
+
+func (f *FaultInjector) delay() time.Duration {
+	d := f.Latency
+	if f.LatencyJitter > 0 {
+		d += time.Duration(f.intn(int(f.LatencyJitter)))
+	}
+	return d
+}
+
+func (f *FaultInjector) forget(c *faultConn) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.conns, c)
+}
+
+// faultConn is a net.Conn on which the faults of the injector are applied.
+type faultConn struct {
+	net.Conn
+	injector *FaultInjector
+
+	lock    sync.Mutex
+	written int64
+	held    []byte
+	closed  atomic.Bool
+}
+
+func (c *faultConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+func (c *faultConn) Read(b []byte) (int, error) {
+	if c.injector.Partitioned(c.LocalAddr().String(), c.RemoteAddr().String()) {
+		c.Close()
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	f := c.injector
+
+	if d := f.delay(); d > 0 {
+		time.Sleep(d)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	if f.Partitioned(c.LocalAddr().String(), c.RemoteAddr().String()) || f.chance(f.DropProbability) {
+		c.Close()
+		return 0, net.ErrClosed
+	}
+
+	buf := make([]byte, len(b))
+	copy(buf, b)
+
+	if len(buf) > 0 && f.chance(f.CorruptProbability) {
+		buf[f.intn(len(buf))] ^= 1 << f.intn(8)
+	}
+
+	// Hold this write back until the next one, or send the one that was
+	// held back after this one.
+	if c.held == nil && f.chance(f.ReorderProbability) {
+		c.held = buf
+		time.AfterFunc(reorderWindow, c.flushHeld)
+		return len(b), nil
+	}
+	if c.held != nil {
+		buf = append(buf, c.held...)
+		c.held = nil
+	}
+
+	if err := c.write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// write writes the buffer to the connection, and drops the connection once
+// DropAfterBytes have been written to it. The lock has to be held.
+func (c *faultConn) write(buf []byte) error {
+	f := c.injector
+
+	if f.DropAfterBytes > 0 && c.written+int64(len(buf)) > f.DropAfterBytes {
+		n := max(f.DropAfterBytes-c.written, 0)
+		c.Conn.Write(buf[:n])
+		c.written += n
+		c.Close()
+		return fmt.Errorf("connection dropped after %d bytes: %w", c.written, net.ErrClosed)
+	}
+
+	if _, err := c.Conn.Write(buf); err != nil {
+		return err
+	}
+	c.written += int64(len(buf))
+	return nil
+}
+
+// flushHeld sends the write that is held back, when no other write came
+// along within the reorder window.
+func (c *faultConn) flushHeld() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.held != nil && !c.closed.Load() {
+		c.write(c.held)
+	}
+	c.held = nil
+}
+
+func (c *faultConn) Close() error {
+	c.closed.Store(true)
+	c.injector.forget(c)
+	return c.Conn.Close()
+}
+
+// FaultyTransport decorates a Transport, so it refuses to dial the nodes
+// that are partitioned from it by the injector.
+type FaultyTransport struct {
+	Transport
+	injector *FaultInjector
+}
+
+func NewFaultyTransport(t Transport, injector *FaultInjector) *FaultyTransport {
+	return &FaultyTransport{
+		Transport: t,
+		injector:  injector,
+	}
+}
+
+func (t *FaultyTransport) Dial(addr string) error {
+	if t.injector.Partitioned(t.Addr(), addr) {
+		return fmt.Errorf("dial %s: network is partitioned", addr)
+	}
+	return t.Transport.Dial(addr)
+}
@@ -0,0 +1,34 @@
+package p2p
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultInjectorDropAfterHeldWrite(t *testing.T) {
+	injector := NewFaultInjector(FaultOpts{
+		Seed:               1,
+		DropAfterBytes:     4,
+		ReorderProbability: 1,
+	})
+
+	a, b := net.Pipe()
+	go io.Copy(io.Discard, b)
+	conn := injector.WrapConn(a)
+
+	// The held write is flushed on its own, and takes the connection past
+	// its limit. That drops the connection, instead of the next write
+	// panicking on it.
+	_, err := conn.Write([]byte("hello world"))
+	assert.Nil(t, err)
+	time.Sleep(2 * reorderWindow)
+
+	assert.NotPanics(t, func() {
+		_, err = conn.Write([]byte("foo"))
+	})
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
@@ -1,5 +1,168 @@
 package p2p
 
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
 type HandshakeFunc func(Peer) error
 
 func NOPHandshakeFunc(Peer) error { return nil }
+
+const (
+	handshakeTimeout = 10 * time.Second
+	handshakeDomain  = "dfs-handshake-v1"
+	// hello: identity public key + ephemeral X25519 public key + random nonce.
+	helloSize = ed25519.PublicKeySize + 32 + 32
+)
+
+var ErrPeerNotAllowed = errors.New("peer identity is not allowed")
+
+type IdentityHandshakeOpts struct {
+	// PrivateKey is the long-term identity key of this node.
+	PrivateKey ed25519.PrivateKey
+	// AllowedKeys is the allowlist of remote identity keys. When it is empty,
+	// every peer that proves possession of its key is accepted.
+	AllowedKeys []ed25519.PublicKey
+}
+
+// sessionPeer is implemented by the peers that can take over the result of
+// a successful identity handshake.
+type sessionPeer interface {
+	setSession(identity ed25519.PublicKey, sendKey, recvKey []byte) error
+}
+
+// NewIdentityHandshakeFunc returns a HandshakeFunc in which both nodes swap their
+// long-term Ed25519 identity keys together with an ephemeral X25519 key, and
+// sign the whole exchange to prove possession of their identity key. The
+// ephemeral keys are used to agree on one session key for each direction,
+// which the peer uses to seal all traffic after the handshake.
+func NewIdentityHandshakeFunc(opts IdentityHandshakeOpts) HandshakeFunc {
+	return func(p Peer) error {
+		sp, ok := p.(sessionPeer)
+		if !ok {
+			return fmt.Errorf("peer %s does not support sessions", p.RemoteAddr())
+		}
+
+		p.SetDeadline(time.Now().Add(handshakeTimeout))
+		defer p.SetDeadline(time.Time{})
+
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+
+		// 1. Swap the hellos
+		hello := make([]byte, 0, helloSize)
+		hello = append(hello, opts.PrivateKey.Public().(ed25519.PublicKey)...)
+		hello = append(hello, ephemeral.PublicKey().Bytes()...)
+		nonce := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return err
+		}
+		hello = append(hello, nonce...)
+
+		remoteHello := make([]byte, helloSize)
+		if err := exchange(p, hello, remoteHello); err != nil {
+			return err
+		}
+
+		remoteIdentity := ed25519.PublicKey(remoteHello[:ed25519.PublicKeySize])
+		if !isAllowed(opts.AllowedKeys, remoteIdentity) {
+			return ErrPeerNotAllowed
+		}
+
+		// 2. Prove that we own the identity key by signing both hellos. As every
+		// hello contains a fresh nonce the signature can not be replayed.
+		sig := ed25519.Sign(opts.PrivateKey, transcript(hello, remoteHello))
+		remoteSig := make([]byte, ed25519.SignatureSize)
+		if err := exchange(p, sig, remoteSig); err != nil {
+			return err
+		}
+
+		if !ed25519.Verify(remoteIdentity, transcript(remoteHello, hello), remoteSig) {
+			return fmt.Errorf("invalid handshake signature from %s", p.RemoteAddr())
+		}
+
+		// 3. Agree on the session keys
+		remoteEphemeral, err := ecdh.X25519().NewPublicKey(remoteHello[ed25519.PublicKeySize : ed25519.PublicKeySize+32])
+		if err != nil {
+			return err
+		}
+		secret, err := ephemeral.ECDH(remoteEphemeral)
+		if err != nil {
+			return err
+		}
+
+		sendKey, recvKey := sessionKeys(secret, hello, remoteHello)
+
+		return sp.setSession(remoteIdentity, sendKey, recvKey)
+	}
+}
+
+// exchange writes out while reading exactly len(in) bytes at the same time, so
+// it does not deadlock on connections without any write buffer.
+func exchange(rw io.ReadWriter, out []byte, in []byte) error {
+	errch := make(chan error, 1)
+	go func() {
+		_, err := rw.Write(out)
+		errch <- err
+	}()
+
+	if _, err := io.ReadFull(rw, in); err != nil {
+		return err
+	}
+
+	return <-errch
+}
+
+func transcript(local, remote []byte) []byte {
+	b := make([]byte, 0, len(handshakeDomain)+len(local)+len(remote))
+	b = append(b, handshakeDomain...)
+	b = append(b, local...)
+	return append(b, remote...)
+}
+
+// sessionKeys derives one key per direction from the shared secret. Both sides
+// order the hellos the same way, so the send key of one side is the receive
+// key of the other.
+func sessionKeys(secret, local, remote []byte) (sendKey, recvKey []byte) {
+	lo, hi := local, remote
+	if bytes.Compare(lo, hi) > 0 {
+		lo, hi = hi, lo
+	}
+
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(handshakeDomain + label))
+		mac.Write(lo)
+		mac.Write(hi)
+		return mac.Sum(nil)
+	}
+
+	a, b := derive("lo->hi"), derive("hi->lo")
+	if bytes.Equal(lo, local) {
+		return a, b
+	}
+	return b, a
+}
+
+func isAllowed(allowed []ed25519.PublicKey, key ed25519.PublicKey) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, k := range allowed {
+		if k.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
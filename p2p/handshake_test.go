@@ -0,0 +1,135 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func handshakePeers(t *testing.T, optsA, optsB IdentityHandshakeOpts) (*TCPPeer, *TCPPeer, error, error) {
+	connA, connB := net.Pipe()
+	peerA := NewTCPPeer(connA, true, nil)
+	peerB := NewTCPPeer(connB, false, nil)
+
+	// Just like the transport does, the connection is closed as soon as
+	// the handshake fails on one of the sides.
+	handshake := func(opts IdentityHandshakeOpts, p *TCPPeer, errch chan error) {
+		err := NewIdentityHandshakeFunc(opts)(p)
+		if err != nil {
+			p.Close()
+		}
+		errch <- err
+	}
+
+	errchA, errchB := make(chan error, 1), make(chan error, 1)
+	go handshake(optsA, peerA, errchA)
+	go handshake(optsB, peerB, errchB)
+	errA, errB := <-errchA, <-errchB
+
+	t.Cleanup(func() {
+		connA.Close()
+		connB.Close()
+	})
+
+	return peerA, peerB, errA, errB
+}
+
+func newIdentity(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+func TestIdentityHandshake(t *testing.T) {
+	pubA, privA := newIdentity(t)
+	pubB, privB := newIdentity(t)
+
+	peerA, peerB, errA, errB := handshakePeers(t,
+		IdentityHandshakeOpts{PrivateKey: privA},
+		IdentityHandshakeOpts{PrivateKey: privB, AllowedKeys: []ed25519.PublicKey{pubA}},
+	)
+	assert.Nil(t, errA)
+	assert.Nil(t, errB)
+	assert.Equal(t, pubB, peerA.Identity())
+	assert.Equal(t, pubA, peerB.Identity())
+
+	// Everything after the handshake is encrypted with the session keys.
+	payload := []byte("foo not bar")
+	go peerA.Send(payload)
+
+	rpc := RPC{}
+	assert.Nil(t, DefaultDecoder{}.Decode(peerB, &rpc))
+	assert.Equal(t, payload, rpc.Payload)
+}
+
+func TestIdentityHandshakeNotAllowed(t *testing.T) {
+	_, privA := newIdentity(t)
+	pubB, privB := newIdentity(t)
+	pubC, _ := newIdentity(t)
+
+	_, _, errA, errB := handshakePeers(t,
+		IdentityHandshakeOpts{PrivateKey: privA, AllowedKeys: []ed25519.PublicKey{pubB}},
+		IdentityHandshakeOpts{PrivateKey: privB, AllowedKeys: []ed25519.PublicKey{pubC}},
+	)
+	assert.NotNil(t, errA)
+	assert.Equal(t, ErrPeerNotAllowed, errB)
+}
+
+func TestIdentityHandshakeDropsTamperedRecord(t *testing.T) {
+	_, privA := newIdentity(t)
+	_, privB := newIdentity(t)
+
+	tests := map[string]func(record []byte) []byte{
+		"changed": func(record []byte) []byte {
+			record[len(record)-1] ^= 1
+			return record
+		},
+		"replayed": func(record []byte) []byte {
+			return append(record, record...)
+		},
+	}
+	for name, tamper := range tests {
+		t.Run(name, func(t *testing.T) {
+			peerA, peerB, errA, errB := handshakePeers(t,
+				IdentityHandshakeOpts{PrivateKey: privA},
+				IdentityHandshakeOpts{PrivateKey: privB},
+			)
+			assert.Nil(t, errA)
+			assert.Nil(t, errB)
+
+			// Seal a frame like peerA would, and tamper with it on its way.
+			record := new(bytes.Buffer)
+			assert.Nil(t, DefaultEncoder{}.Encode(sessionWriter{peerA.session, record}, &Frame{Kind: IncomingMessage, Payload: []byte("foo")}))
+			go peerA.Conn.Write(tamper(record.Bytes()))
+
+			rpc := RPC{}
+			err := DefaultDecoder{}.Decode(peerB, &rpc)
+			if name == "replayed" {
+				assert.Nil(t, err)
+				err = DefaultDecoder{}.Decode(peerB, &rpc)
+			}
+			assert.ErrorIs(t, err, ErrSessionAuth)
+
+			// The connection is closed, so the peer is dropped.
+			_, err = peerB.Conn.Write([]byte{0})
+			assert.ErrorIs(t, err, io.ErrClosedPipe)
+		})
+	}
+}
+
+// sessionWriter seals everything that is written to it with the session.
+type sessionWriter struct {
+	session *session
+	w       *bytes.Buffer
+}
+
+func (w sessionWriter) Write(b []byte) (int, error) {
+	return w.session.write(w.w, b)
+}
@@ -0,0 +1,280 @@
+package p2p
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// MemNetwork is an in-process network that connects MemTransports by their
+// listen address, without binding any ports.
+type MemNetwork struct {
+	lock      sync.Mutex
+	listeners map[string]*MemTransport
+	lastConn  int
+}
+
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{
+		listeners: make(map[string]*MemTransport),
+	}
+}
+
+func (n *MemNetwork) listen(addr string, t *MemTransport) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if _, ok := n.listeners[addr]; ok {
+		return fmt.Errorf("mem address already in use: %s", addr)
+	}
+	n.listeners[addr] = t
+	return nil
+}
+
+func (n *MemNetwork) listener(addr string) (*MemTransport, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	t, ok := n.listeners[addr]
+	return t, ok
+}
+
+// dialAddr returns a unique address for the dialing side of a connection, just
+// like TCP picks an ephemeral port for it: the listen address of the dialing
+// transport followed by "#" and a sequence number.
+func (n *MemNetwork) dialAddr(listenAddr string) string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.lastConn++
+	return fmt.Sprintf("%s#%d", listenAddr, n.lastConn)
+}
+
+func (n *MemNetwork) remove(addr string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	delete(n.listeners, addr)
+}
+
+type MemTransportOpts struct {
+	TCPTransportOpts
+	Network *MemNetwork
+}
+
+// MemTransport is a Transport of which the connections are in-memory pipes
+// on a MemNetwork. Everything on top of the connections works exactly the
+// same as it does for the TCPTransport.
+type MemTransport struct {
+	*TCPTransport
+	network *MemNetwork
+}
+
+func NewMemTransport(opts MemTransportOpts) *MemTransport {
+	return &MemTransport{
+		TCPTransport: NewTCPTransport(opts.TCPTransportOpts),
+		network:      opts.Network,
+	}
+}
+
+// Dial implements the Transport interface, which will connect to the transport
+// listening on addr in the same MemNetwork.
+func (t *MemTransport) Dial(addr string) error {
+	remote, ok := t.network.listener(addr)
+	if !ok {
+		return fmt.Errorf("dial mem %s: connection refused", addr)
+	}
+
+	local, conn := newMemPipe(t.network.dialAddr(t.ListenAddr), addr)
+
+	go t.handleConn(local, true)
+	go remote.handleConn(conn, false)
+
+	return nil
+}
+
+func (t *MemTransport) ListenAndAccept() error {
+	return t.network.listen(t.ListenAddr, t)
+}
+
+// Close implements the Transport interface, which will remove the transport
+// from the network, so nobody can dial it anymore, and close the connections
+// of all peers.
+func (t *MemTransport) Close() error {
+	t.closeConns()
+	t.network.remove(t.ListenAddr)
+	return nil
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+// memBuffer is one direction of a memPipe. Writes never block, just like
+// writes to a TCP connection with a large enough buffer.
+type memBuffer struct {
+	lock   sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+	// notify is closed and replaced every time something changes.
+	notify chan struct{}
+}
+
+func newMemBuffer() *memBuffer {
+	return &memBuffer{notify: make(chan struct{})}
+}
+
+func (b *memBuffer) signal() {
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+func (b *memBuffer) write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	n, _ := b.buf.Write(p)
+	b.signal()
+	return n, nil
+}
+
+func (b *memBuffer) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		b.signal()
+	}
+}
+
+// memConn is one side of an in-memory connection.
+type memConn struct {
+	local  memAddr
+	remote memAddr
+	rbuf   *memBuffer
+	wbuf   *memBuffer
+
+	lock          sync.Mutex
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newMemPipe(localAddr, remoteAddr string) (*memConn, *memConn) {
+	a, b := newMemBuffer(), newMemBuffer()
+
+	return &memConn{local: memAddr(localAddr), remote: memAddr(remoteAddr), rbuf: a, wbuf: b},
+		&memConn{local: memAddr(remoteAddr), remote: memAddr(localAddr), rbuf: b, wbuf: a}
+}
+
+func (c *memConn) Read(p []byte) (int, error) {
+	for {
+		c.lock.Lock()
+		closed, deadline := c.closed, c.readDeadline
+		c.lock.Unlock()
+
+		if closed {
+			return 0, net.ErrClosed
+		}
+
+		c.rbuf.lock.Lock()
+		if c.rbuf.buf.Len() > 0 {
+			n, _ := c.rbuf.buf.Read(p)
+			c.rbuf.lock.Unlock()
+			return n, nil
+		}
+		if c.rbuf.closed {
+			c.rbuf.lock.Unlock()
+			return 0, io.EOF
+		}
+		notify := c.rbuf.notify
+		c.rbuf.lock.Unlock()
+
+		if deadline.IsZero() {
+			<-notify
+			continue
+		}
+
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		timer := time.NewTimer(d)
+		select {
+		case <-notify:
+			timer.Stop()
+		case <-timer.C:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (c *memConn) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	closed, deadline := c.closed, c.writeDeadline
+	c.lock.Unlock()
+
+	if closed {
+		return 0, net.ErrClosed
+	}
+	if !deadline.IsZero() && time.Now().After(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	return c.wbuf.write(p)
+}
+
+func (c *memConn) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.lock.Unlock()
+
+	// Wake up our own readers, and let the remote side read EOF once it
+	// has drained everything we wrote.
+	c.rbuf.close()
+	c.wbuf.close()
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readDeadline = t
+	c.lock.Unlock()
+
+	// Wake up the readers, so they pick up the new deadline.
+	c.rbuf.lock.Lock()
+	c.rbuf.signal()
+	c.rbuf.lock.Unlock()
+	return nil
+}
+
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.writeDeadline = t
+	return nil
+}
@@ -0,0 +1,61 @@
+package p2p
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemTransport(t *testing.T) {
+	network := NewMemNetwork()
+
+	newTransport := func(addr string) *MemTransport {
+		return NewMemTransport(MemTransportOpts{
+			TCPTransportOpts: TCPTransportOpts{
+				ListenAddr:    addr,
+				HandshakeFunc: NOPHandshakeFunc,
+				Decoder:       DefaultDecoder{},
+			},
+			Network: network,
+		})
+	}
+
+	a, b := newTransport("a"), newTransport("b")
+	peerch := make(chan Peer, 1)
+	b.OnPeer = func(p Peer) error {
+		peerch <- p
+		return nil
+	}
+
+	assert.Nil(t, a.ListenAndAccept())
+	assert.Nil(t, b.ListenAndAccept())
+	assert.NotNil(t, a.ListenAndAccept())
+	assert.NotNil(t, a.Dial("c"))
+
+	peers := make(chan Peer, 1)
+	a.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+	assert.Nil(t, a.Dial("b"))
+
+	peerA := <-peers
+	assert.Equal(t, "b", peerA.RemoteAddr().String())
+	assert.Equal(t, "a#1", (<-peerch).RemoteAddr().String())
+
+	assert.Nil(t, peerA.Send([]byte("foo")))
+	select {
+	case rpc := <-b.Consume():
+		assert.Equal(t, "a#1", rpc.From)
+		assert.Equal(t, []byte("foo"), rpc.Payload)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting on the message")
+	}
+
+	// Reads time out once the deadline passes.
+	peerA.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := peerA.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
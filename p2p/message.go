@@ -1,14 +1,68 @@
 package p2p
 
+import "io"
+
 const (
 	IncomingMessage = 0x1
 	IncomingStream  = 0x2
+	// IncomingPing and IncomingPong are the heartbeat frames, which keep an
+	// idle connection alive. They never reach the consumer of the transport.
+	IncomingPing = 0x3
+	IncomingPong = 0x4
+	// The body of a stream follows its IncomingStream frame in StreamData
+	// frames, until a StreamClose frame. The receiving side grants more of
+	// the window with StreamWindowUpdate frames, or stops the stream with a
+	// StreamReset frame. Every stream frame starts with the stream ID.
+	StreamData         = 0x5
+	StreamClose        = 0x6
+	StreamWindowUpdate = 0x7
+	StreamReset        = 0x8
 )
 
+// FrameHeaderSize is the size in bytes of an encoded FrameHeader on the wire:
+// 1 byte kind, 1 byte flags and a 4 byte big-endian payload length.
+const FrameHeaderSize = 6
+
+// MaxFrameSize is the largest payload a single frame is allowed to carry.
+// Anything bigger than this should be sent as a stream instead.
+const MaxFrameSize = 16 << 20 // 16MB
+
+// FrameHeader precedes every frame that is being sent over the wire, so the
+// receiving side knows what kind of frame it is and exactly how many bytes
+// of payload it has to read before the next frame starts.
+type FrameHeader struct {
+	Kind   byte
+	Flags  byte
+	Length uint32
+}
+
+// Frame is a single unit of data that is being sent between two peers.
+type Frame struct {
+	Kind    byte
+	Flags   byte
+	Payload []byte
+}
+
 // RPC holds any arbitrary data that is being sent over
 // each transport between the nodes in the network.
 type RPC struct {
 	From    string
 	Payload []byte
 	Stream  bool
+	// Body is the body of the stream, when Stream is set. It has to be
+	// closed once the consumer is done with it.
+	Body io.ReadCloser
+	// Kind is the kind of the frame the RPC was read from.
+	Kind byte
+	// accepted is closed by Accept, when the transport awaits it.
+	accepted chan struct{}
+}
+
+// Accept tells the transport that the consumer took the RPC on, after which
+// the next RPC of the same peer is delivered. It only has to be called when
+// the transport has AwaitAccept set, and may be called from any goroutine.
+func (rpc RPC) Accept() {
+	if rpc.accepted != nil {
+		close(rpc.accepted)
+	}
 }
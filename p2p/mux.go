@@ -0,0 +1,434 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// StreamWindow is how many bytes of a stream may be sent before the receiving
+// side read them. Every stream has its own window, so a stream that isn't read
+// only holds up itself, never the other streams or messages of the peer.
+const StreamWindow = 256 << 10 // 256KB
+
+// maxDataFrame is the largest chunk of a stream body sent in a single frame,
+// so the frames of several streams take turns on the connection.
+const maxDataFrame = 32 << 10 // 32KB
+
+// streamIDSize is the size of the stream ID every stream frame starts with.
+const streamIDSize = 4
+
+// ErrStreamReset is returned when the receiving side closed the stream before
+// it read the whole body.
+var ErrStreamReset = errors.New("stream reset by peer")
+
+// inStream is the receiving side of a stream. The read loop of the peer
+// buffers the body, up to the window, until the consumer reads it.
+type inStream struct {
+	id      uint32
+	peer    *TCPPeer
+	timeout time.Duration
+
+	lock sync.Mutex
+	buf  bytes.Buffer
+	// consumed is the number of bytes read since the last window update.
+	consumed int
+	// fin is set once the whole body arrived, and closed once the stream is
+	// closed on our side.
+	fin    bool
+	closed bool
+	err    error
+	// notify is closed and replaced every time something changes.
+	notify chan struct{}
+}
+
+func (s *inStream) signal() {
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// push hands data that arrived over the connection to the stream.
+func (s *inStream) push(data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.buf.Len()+len(data) > StreamWindow {
+		return fmt.Errorf("stream %d: peer exceeded the window", s.id)
+	}
+	s.buf.Write(data)
+	s.signal()
+	return nil
+}
+
+// finish ends the stream, either because the whole body arrived, when err is
+// nil, or because it never will.
+func (s *inStream) finish(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err == nil {
+		s.fin = true
+	} else if s.err == nil {
+		s.err = err
+	}
+	s.signal()
+}
+
+// Read reads the body of the stream. It fails when nothing arrives within the
+// IOTimeout of the transport, after which the stream is reset.
+func (s *inStream) Read(b []byte) (int, error) {
+	var deadline time.Time
+	if s.timeout > 0 {
+		deadline = time.Now().Add(s.timeout)
+	}
+
+	for {
+		s.lock.Lock()
+		if s.buf.Len() > 0 {
+			n, _ := s.buf.Read(b)
+			s.consumed += n
+
+			// Hand the bytes back to the sender once half of the window is
+			// used up, so it never has to stop while we keep up.
+			var update int
+			if s.consumed >= StreamWindow/2 && !s.fin {
+				update, s.consumed = s.consumed, 0
+			}
+			s.lock.Unlock()
+
+			if update > 0 {
+				s.peer.sendStreamFrame(StreamWindowUpdate, s.id, binary.BigEndian.AppendUint32(nil, uint32(update)))
+			}
+			return n, nil
+		}
+		if s.fin {
+			s.lock.Unlock()
+			return 0, io.EOF
+		}
+		if s.err != nil {
+			err := s.err
+			s.lock.Unlock()
+			return 0, err
+		}
+		notify := s.notify
+		s.lock.Unlock()
+
+		if deadline.IsZero() {
+			<-notify
+			continue
+		}
+
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-notify:
+			timer.Stop()
+		case <-timer.C:
+			err := fmt.Errorf("%w: stream %d: %s", ErrPeerTimeout, s.id, os.ErrDeadlineExceeded)
+			s.finish(err)
+			s.Close()
+			return 0, err
+		}
+	}
+}
+
+// Close stops reading the stream. When the body didn't arrive as a whole, the
+// sender is told to stop sending the rest.
+func (s *inStream) Close() error {
+	s.lock.Lock()
+	done, closed := s.fin, s.closed
+	s.closed = true
+	s.buf.Reset()
+	if s.err == nil {
+		s.err = io.ErrClosedPipe
+	}
+	s.lock.Unlock()
+
+	if !closed {
+		s.peer.releaseIncoming()
+	}
+	if s.peer.removeIncoming(s.id) && !done {
+		s.peer.sendStreamFrame(StreamReset, s.id, nil)
+	}
+	return nil
+}
+
+// outStream is the sending side of a stream.
+type outStream struct {
+	lock   sync.Mutex
+	window int
+	err    error
+	notify chan struct{}
+}
+
+func (s *outStream) signal() {
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+func (s *outStream) grow(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.window += n
+	s.signal()
+}
+
+func (s *outStream) fail(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+	s.signal()
+}
+
+// reserve waits until some of the window is free, and takes up to n bytes of it.
+func (s *outStream) reserve(n int, timeout time.Duration) (int, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for {
+		s.lock.Lock()
+		if s.err != nil {
+			err := s.err
+			s.lock.Unlock()
+			return 0, err
+		}
+		if s.window > 0 {
+			n = min(n, s.window)
+			s.window -= n
+			s.lock.Unlock()
+			return n, nil
+		}
+		notify := s.notify
+		s.lock.Unlock()
+
+		if deadline.IsZero() {
+			<-notify
+			continue
+		}
+
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-notify:
+			timer.Stop()
+		case <-timer.C:
+			return 0, fmt.Errorf("%w: the window stayed full: %s", ErrPeerTimeout, os.ErrDeadlineExceeded)
+		}
+	}
+}
+
+// SendStream implements the Peer interface, which will send header to the remote
+// node as a new stream, followed by everything that is read from r. The body
+// is sent in frames, within the window the remote node grants, so any number
+// of streams and messages can be sent at the same time.
+func (p *TCPPeer) SendStream(header []byte, r io.Reader) (int64, error) {
+	id, stream := p.openOutgoing()
+	defer p.removeOutgoing(id)
+
+	if err := p.sendStreamFrame(IncomingStream, id, header); err != nil {
+		return 0, err
+	}
+
+	var (
+		buf  = make([]byte, maxDataFrame)
+		sent int64
+	)
+	for {
+		n, rerr := r.Read(buf)
+		for off := 0; off < n; {
+			k, err := stream.reserve(n-off, p.writeTimeout)
+			if err == nil {
+				err = p.sendStreamFrame(StreamData, id, buf[off:off+k])
+			}
+			if err != nil {
+				if !errors.Is(err, ErrStreamReset) {
+					p.sendStreamFrame(StreamClose, id, nil)
+				}
+				return sent, err
+			}
+			off += k
+			sent += int64(k)
+		}
+
+		if rerr != nil {
+			// The receiver sees a body that is too short when we fail to
+			// read it, just like it would when the connection drops.
+			p.sendStreamFrame(StreamClose, id, nil)
+			if rerr == io.EOF {
+				return sent, nil
+			}
+			return sent, rerr
+		}
+	}
+}
+
+func (p *TCPPeer) sendStreamFrame(kind byte, id uint32, data []byte) error {
+	payload := make([]byte, streamIDSize+len(data))
+	binary.BigEndian.PutUint32(payload, id)
+	copy(payload[streamIDSize:], data)
+
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+
+	return p.encoder.Encode(p, &Frame{Kind: kind, Payload: payload})
+}
+
+func (p *TCPPeer) openOutgoing() (uint32, *outStream) {
+	p.streamLock.Lock()
+	defer p.streamLock.Unlock()
+
+	p.nextStreamID++
+	stream := &outStream{window: StreamWindow, notify: make(chan struct{})}
+	p.outgoing[p.nextStreamID] = stream
+	return p.nextStreamID, stream
+}
+
+func (p *TCPPeer) removeOutgoing(id uint32) {
+	p.streamLock.Lock()
+	defer p.streamLock.Unlock()
+
+	delete(p.outgoing, id)
+}
+
+// removeIncoming forgets the stream, and reports whether it was still known.
+func (p *TCPPeer) removeIncoming(id uint32) bool {
+	p.streamLock.Lock()
+	defer p.streamLock.Unlock()
+
+	_, ok := p.incoming[id]
+	delete(p.incoming, id)
+	return ok
+}
+
+// releaseIncoming makes room for another incoming stream, once the consumer
+// closed one.
+func (p *TCPPeer) releaseIncoming() {
+	p.streamLock.Lock()
+	defer p.streamLock.Unlock()
+
+	p.open--
+}
+
+// queueReset has the stream reset, without the read loop waiting on a stream
+// we are sending to the peer. A peer that opens streams faster than they are
+// reset, while maxIncoming resets are waiting already, is dropped.
+func (p *TCPPeer) queueReset(id uint32) error {
+	p.streamLock.Lock()
+	defer p.streamLock.Unlock()
+
+	if len(p.resets) >= p.maxIncoming {
+		return fmt.Errorf("%d streams are waiting to be reset", len(p.resets))
+	}
+	p.resets = append(p.resets, id)
+	if !p.resetting {
+		p.resetting = true
+		go p.sendResets()
+	}
+	return nil
+}
+
+// sendResets sends the resets that are queued, until none are left.
+func (p *TCPPeer) sendResets() {
+	for {
+		p.streamLock.Lock()
+		if len(p.resets) == 0 {
+			p.resetting = false
+			p.streamLock.Unlock()
+			return
+		}
+		id := p.resets[0]
+		p.resets = p.resets[1:]
+		p.streamLock.Unlock()
+
+		p.sendStreamFrame(StreamReset, id, nil)
+	}
+}
+
+// demux handles a stream frame that was read from the connection. It returns
+// true, with the header in the payload and the body set, when the frame
+// opened a stream the consumer has to handle.
+func (p *TCPPeer) demux(rpc *RPC, timeout time.Duration) (bool, error) {
+	if len(rpc.Payload) < streamIDSize {
+		return false, fmt.Errorf("stream frame too short: %d bytes", len(rpc.Payload))
+	}
+	id := binary.BigEndian.Uint32(rpc.Payload)
+	data := rpc.Payload[streamIDSize:]
+
+	p.streamLock.Lock()
+	in, out := p.incoming[id], p.outgoing[id]
+	p.streamLock.Unlock()
+
+	switch rpc.Kind {
+	case IncomingStream:
+		if in != nil {
+			return false, fmt.Errorf("stream %d opened twice", id)
+		}
+		in = &inStream{id: id, peer: p, timeout: timeout, notify: make(chan struct{})}
+
+		p.streamLock.Lock()
+		full := p.maxIncoming > 0 && p.open >= p.maxIncoming
+		if !full {
+			p.incoming[id] = in
+			p.open++
+		}
+		p.streamLock.Unlock()
+
+		// The rest of the stream is ignored, as it is unknown.
+		if full {
+			return false, p.queueReset(id)
+		}
+
+		rpc.Payload, rpc.Body = data, in
+		return true, nil
+	case StreamData:
+		// The consumer might have closed the stream already.
+		if in != nil {
+			return false, in.push(data)
+		}
+	case StreamClose:
+		if in != nil {
+			p.removeIncoming(id)
+			in.finish(nil)
+		}
+	case StreamWindowUpdate:
+		if len(data) < 4 {
+			return false, fmt.Errorf("window update too short: %d bytes", len(data))
+		}
+		if out != nil {
+			out.grow(int(binary.BigEndian.Uint32(data)))
+		}
+	case StreamReset:
+		if out != nil {
+			out.fail(ErrStreamReset)
+		}
+	}
+	return false, nil
+}
+
+// closeStreams fails every stream that is still open, once the connection is gone.
+func (p *TCPPeer) closeStreams(err error) {
+	if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+
+	p.streamLock.Lock()
+	incoming, outgoing := p.incoming, p.outgoing
+	p.incoming, p.outgoing = make(map[uint32]*inStream), make(map[uint32]*outStream)
+	p.streamLock.Unlock()
+
+	for _, in := range incoming {
+		in.finish(fmt.Errorf("connection closed: %w", err))
+	}
+	for _, out := range outgoing {
+		out.fail(fmt.Errorf("connection closed: %w", err))
+	}
+}
@@ -0,0 +1,208 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMux(t *testing.T) {
+	network := NewMemNetwork()
+
+	newTransport := func(addr string) *MemTransport {
+		tr := NewMemTransport(MemTransportOpts{
+			TCPTransportOpts: TCPTransportOpts{
+				ListenAddr:    addr,
+				HandshakeFunc: NOPHandshakeFunc,
+				Decoder:       DefaultDecoder{},
+			},
+			Network: network,
+		})
+		assert.Nil(t, tr.ListenAndAccept())
+		return tr
+	}
+
+	a, b := newTransport("a"), newTransport("b")
+	peers := make(chan Peer, 1)
+	a.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+	assert.Nil(t, a.Dial("b"))
+	peer := <-peers
+
+	consume := func() RPC {
+		select {
+		case rpc := <-b.Consume():
+			return rpc
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting on the rpc")
+			return RPC{}
+		}
+	}
+
+	// Both bodies are larger than the window, so neither can be sent as a
+	// whole before it is read.
+	bodies := [][]byte{
+		bytes.Repeat([]byte("a"), 3*StreamWindow),
+		bytes.Repeat([]byte("b"), 2*StreamWindow+1),
+	}
+	sent := make(chan error, len(bodies))
+	for i, body := range bodies {
+		go func() {
+			n, err := peer.SendStream([]byte{byte(i)}, bytes.NewReader(body))
+			assert.Equal(t, int64(len(body)), n)
+			sent <- err
+		}()
+	}
+
+	streams := make(map[byte]io.ReadCloser)
+	for range bodies {
+		rpc := consume()
+		assert.True(t, rpc.Stream)
+		streams[rpc.Payload[0]] = rpc.Body
+	}
+
+	// Messages are not held up by the streams nobody reads.
+	assert.Nil(t, peer.Send([]byte("foo")))
+	assert.Equal(t, []byte("foo"), consume().Payload)
+
+	// The second stream is read first, while the first one waits.
+	for _, i := range []byte{1, 0} {
+		body, err := io.ReadAll(streams[i])
+		assert.Nil(t, err)
+		assert.Equal(t, bodies[i], body)
+		assert.Nil(t, streams[i].Close())
+	}
+
+	for range bodies {
+		assert.Nil(t, <-sent)
+	}
+}
+
+// muxPair connects a to b, and returns the peer of each of them.
+func muxPair(t *testing.T, optsA, optsB TCPTransportOpts) (*MemTransport, *MemTransport, Peer, Peer) {
+	network := NewMemNetwork()
+
+	newTransport := func(addr string, opts TCPTransportOpts) (*MemTransport, chan Peer) {
+		opts.ListenAddr = addr
+		opts.HandshakeFunc = NOPHandshakeFunc
+		opts.Decoder = DefaultDecoder{}
+		tr := NewMemTransport(MemTransportOpts{TCPTransportOpts: opts, Network: network})
+
+		peers := make(chan Peer, 1)
+		tr.OnPeer = func(p Peer) error {
+			peers <- p
+			return nil
+		}
+		assert.Nil(t, tr.ListenAndAccept())
+		return tr, peers
+	}
+
+	a, peersA := newTransport("a", optsA)
+	b, peersB := newTransport("b", optsB)
+	assert.Nil(t, a.Dial("b"))
+	return a, b, <-peersA, <-peersB
+}
+
+func TestMuxMaxIncomingStreams(t *testing.T) {
+	_, b, peer, _ := muxPair(t, TCPTransportOpts{}, TCPTransportOpts{MaxIncomingStreams: 1})
+
+	// The body is larger than the window, so the sender finds out about the
+	// reset while it is still sending.
+	body := bytes.Repeat([]byte("a"), 2*StreamWindow)
+	send := func() chan error {
+		sent := make(chan error, 1)
+		go func() {
+			_, err := peer.SendStream([]byte("foo"), bytes.NewReader(body))
+			sent <- err
+		}()
+		return sent
+	}
+
+	first := send()
+	rpc := <-b.Consume()
+	assert.True(t, rpc.Stream)
+
+	// The consumer didn't close the first stream yet.
+	assert.ErrorIs(t, <-send(), ErrStreamReset)
+
+	_, err := io.ReadAll(rpc.Body)
+	assert.Nil(t, err)
+	assert.Nil(t, rpc.Body.Close())
+	assert.Nil(t, <-first)
+
+	third := send()
+	rpc = <-b.Consume()
+	_, err = io.ReadAll(rpc.Body)
+	assert.Nil(t, err)
+	assert.Nil(t, rpc.Body.Close())
+	assert.Nil(t, <-third)
+}
+
+func TestMuxQueuesResets(t *testing.T) {
+	// Nothing reads what the peer sends, so the resets stay queued.
+	conn, other := net.Pipe()
+	defer other.Close()
+	defer conn.Close()
+
+	peer := NewTCPPeer(conn, false, nil)
+	peer.maxIncoming = 1
+
+	open := func(id uint32) (bool, error) {
+		rpc := RPC{Kind: IncomingStream, Payload: binary.BigEndian.AppendUint32(nil, id)}
+		return peer.demux(&rpc, 0)
+	}
+	opened, err := open(1)
+	assert.True(t, opened)
+	assert.Nil(t, err)
+
+	// The streams beyond the first are reset by a single goroutine, and the
+	// peer is dropped once it opens more than can wait to be reset.
+	goroutines := runtime.NumGoroutine()
+	for id := uint32(2); ; id++ {
+		opened, err := open(id)
+		assert.False(t, opened)
+		if err != nil {
+			break
+		}
+		if id > 10 {
+			t.Fatal("expected the peer to be dropped")
+		}
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines+1)
+}
+
+func TestMuxStreamsDontHoldUpWindowUpdates(t *testing.T) {
+	a, _, peerA, peerB := muxPair(t,
+		TCPTransportOpts{},
+		TCPTransportOpts{RPCBufferSize: 1, IOTimeout: time.Second},
+	)
+
+	// b doesn't consume the streams a opens, while it sends a body larger
+	// than the window to a, which only arrives as a whole when b keeps
+	// handling the window updates of a.
+	for range 3 {
+		go peerA.SendStream([]byte("foo"), bytes.NewReader([]byte("bar")))
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	body := bytes.Repeat([]byte("b"), 3*StreamWindow)
+	sent := make(chan error, 1)
+	go func() {
+		_, err := peerB.SendStream([]byte("baz"), bytes.NewReader(body))
+		sent <- err
+	}()
+
+	rpc := <-a.Consume()
+	received, err := io.ReadAll(rpc.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, body, received)
+	assert.Nil(t, <-sent)
+}
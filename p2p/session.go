@@ -0,0 +1,120 @@
+package p2p
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrSessionAuth is the reason a peer is dropped with, when a record it sent
+// failed authentication.
+var ErrSessionAuth = errors.New("session record failed authentication")
+
+// maxRecordSize is the most plaintext that is sealed in one record, which is
+// the largest frame. Larger writes are split over several records.
+const maxRecordSize = FrameHeaderSize + MaxFrameSize
+
+// recordHeaderSize is the size of the length that precedes every record.
+const recordHeaderSize = 4
+
+// session seals everything that is sent with AES-GCM, and opens everything that
+// is received. A record is the length of the sealed bytes followed by the sealed
+// bytes themselves, of which the nonce is the number of records that were
+// sealed with the key before, so a record that is dropped, replayed or
+// reordered fails to open just like one that was changed.
+type session struct {
+	sendLock  sync.Mutex
+	send      cipher.AEAD
+	sendCount uint64
+
+	recv      cipher.AEAD
+	recvCount uint64
+	// pending holds what is left of the last record that was opened.
+	pending []byte
+}
+
+func newSession(sendKey, recvKey []byte) (*session, error) {
+	send, err := newGCM(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newGCM(recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session{send: send, recv: recv}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// recordNonce returns the nonce of the record with the given number.
+func recordNonce(aead cipher.AEAD, count uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], count)
+	return nonce
+}
+
+// write seals b in records, which are written to w with a single call.
+func (s *session) write(w io.Writer, b []byte) (int, error) {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+
+	var buf []byte
+	for rest := b; len(rest) > 0; {
+		plain := rest[:min(len(rest), maxRecordSize)]
+		rest = rest[len(plain):]
+
+		start := len(buf)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(plain)+s.send.Overhead()))
+		buf = s.send.Seal(buf, recordNonce(s.send, s.sendCount), plain, buf[start:])
+		s.sendCount++
+	}
+
+	if _, err := w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// read opens the next record from r when nothing is left of the last one, and
+// reads from what it holds.
+func (s *session) read(r io.Reader, b []byte) (int, error) {
+	if len(s.pending) == 0 {
+		var header [recordHeaderSize]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return 0, err
+		}
+
+		size := binary.BigEndian.Uint32(header[:])
+		if size < uint32(s.recv.Overhead()) || size > uint32(maxRecordSize+s.recv.Overhead()) {
+			return 0, fmt.Errorf("%w: record of %d bytes", ErrSessionAuth, size)
+		}
+
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(r, sealed); err != nil {
+			return 0, err
+		}
+
+		plain, err := s.recv.Open(sealed[:0], recordNonce(s.recv, s.recvCount), sealed, header[:])
+		if err != nil {
+			return 0, ErrSessionAuth
+		}
+		s.recvCount++
+		s.pending = plain
+	}
+
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
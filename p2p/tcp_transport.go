@@ -1,13 +1,26 @@
 package p2p
 
 import (
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"sync"
+	"time"
 )
 
+// DefaultRPCBufferSize is the default of the RPCBufferSize.
+const DefaultRPCBufferSize = 1024
+
+// DefaultMaxIncomingStreams is the default of the MaxIncomingStreams.
+const DefaultMaxIncomingStreams = 64
+
+// ErrPeerTimeout is the reason a peer is dropped with, when it didn't send
+// anything within the IdleTimeout or stalled within the IOTimeout.
+var ErrPeerTimeout = errors.New("peer timed out")
+
 // TCPPeer represents the remote node over a TCP established connection.
 type TCPPeer struct {
 	// The underlying connection of the peer. Which in this case
@@ -16,44 +29,236 @@ type TCPPeer struct {
 	// if we dail and retrieve a conn => outbound = true
 	// if we accept and retrieve a conn => outbound = false
 	outbound bool
-
-	wg *sync.WaitGroup
+	// encoder is used to frame everything we send to the remote node.
+	encoder Encoder
+	// sendLock makes sure a frame, or a stream with its body, is written to
+	// the connection as a whole and never interleaved with another send.
+	sendLock sync.Mutex
+
+	// identity is the verified identity key of the remote node, set by the
+	// identity handshake. The session seals everything after it: every write,
+	// which is a single frame, is sealed in a record of its own.
+	identity ed25519.PublicKey
+	session  *session
+
+	// writeTimeout bounds every single write, and how long a stream may wait
+	// on the window, when it is not zero.
+	writeTimeout time.Duration
+	// failure is the first error a read or write of the connection failed
+	// with, after which the connection is closed.
+	failLock sync.Mutex
+	failure  error
+
+	// streamLock guards the streams that are multiplexed over the connection.
+	// The IDs of the incoming streams are picked by the remote node, the IDs
+	// of the outgoing ones by us.
+	streamLock   sync.Mutex
+	nextStreamID uint32
+	incoming     map[uint32]*inStream
+	outgoing     map[uint32]*outStream
+	// open is the number of incoming streams the consumer didn't close yet,
+	// of which there may be maxIncoming at once, when it is not zero.
+	open        int
+	maxIncoming int
+	// resets are the IDs of the streams beyond maxIncoming that still have
+	// to be reset. They are sent one after another by a single goroutine,
+	// which runs while resetting is set.
+	resets    []uint32
+	resetting bool
 }
 
-func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
+func NewTCPPeer(conn net.Conn, outbound bool, encoder Encoder) *TCPPeer {
+	if encoder == nil {
+		encoder = DefaultEncoder{}
+	}
+
 	return &TCPPeer{
 		Conn:     conn,
 		outbound: outbound,
-		wg:       &sync.WaitGroup{},
+		encoder:  encoder,
+		incoming: make(map[uint32]*inStream),
+		outgoing: make(map[uint32]*outStream),
 	}
 }
 
-func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+// Identity implements the Peer interface, which will return the identity key
+// the remote node proved to own during the handshake, or nil without one.
+func (p *TCPPeer) Identity() ed25519.PublicKey {
+	return p.identity
 }
 
+func (p *TCPPeer) setSession(identity ed25519.PublicKey, sendKey, recvKey []byte) error {
+	session, err := newSession(sendKey, recvKey)
+	if err != nil {
+		return err
+	}
+
+	p.identity = identity
+	p.session = session
+	return nil
+}
+
+func (p *TCPPeer) Read(b []byte) (int, error) {
+	if p.session != nil {
+		n, err := p.session.read(p.Conn, b)
+		if errors.Is(err, ErrSessionAuth) {
+			// Someone tampered with the connection, nothing that is read
+			// from it can be trusted anymore.
+			p.Conn.Close()
+		} else if err != nil {
+			p.fail(err)
+		}
+		return n, err
+	}
+
+	n, err := p.Conn.Read(b)
+	if err != nil {
+		p.fail(err)
+	}
+	return n, err
+}
+
+func (p *TCPPeer) Write(b []byte) (int, error) {
+	if p.writeTimeout > 0 {
+		p.Conn.SetWriteDeadline(time.Now().Add(p.writeTimeout))
+	}
+
+	var (
+		n   int
+		err error
+	)
+	if p.session != nil {
+		n, err = p.session.write(p.Conn, b)
+	} else {
+		n, err = p.Conn.Write(b)
+	}
+	if err != nil {
+		p.fail(err)
+	}
+	return n, err
+}
+
+// fail closes the connection once a read or write of it timed out. Whatever
+// was read or written of the frame or stream at that point can't be taken
+// back, so the connection is of no use anymore.
+func (p *TCPPeer) fail(err error) {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return
+	}
+
+	p.failLock.Lock()
+	if p.failure == nil {
+		p.failure = fmt.Errorf("%w: %s", ErrPeerTimeout, err)
+	}
+	p.failLock.Unlock()
+
+	p.Conn.Close()
+}
+
+// err returns why the connection of the peer was closed, if it timed out.
+func (p *TCPPeer) err() error {
+	p.failLock.Lock()
+	defer p.failLock.Unlock()
+
+	return p.failure
+}
+
+// Outbound implements the Peer interface.
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
+}
+
+// Send implements the Peer interface, which will send b to the remote node
+// as a single message frame.
 func (p *TCPPeer) Send(b []byte) error {
-	_, err := p.Conn.Write(b)
-	return err
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+
+	return p.encoder.Encode(p, &Frame{Kind: IncomingMessage, Payload: b})
+}
+
+// ping sends a heartbeat to the remote node, unless something else is being
+// sent already, which keeps the connection alive just as well.
+func (p *TCPPeer) ping() error {
+	if !p.sendLock.TryLock() {
+		return nil
+	}
+	defer p.sendLock.Unlock()
+
+	return p.encoder.Encode(p, &Frame{Kind: IncomingPing})
+}
+
+func (p *TCPPeer) pong() error {
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+
+	return p.encoder.Encode(p, &Frame{Kind: IncomingPong})
 }
 
 type TCPTransportOpts struct {
 	ListenAddr    string
 	HandshakeFunc HandshakeFunc
 	Decoder       Decoder
+	Encoder       Encoder
 	OnPeer        func(Peer) error
+	// OnPeerDisconnect is called with the reason once the connection of a peer,
+	// that was accepted by OnPeer, is closed.
+	OnPeerDisconnect func(Peer, error)
+	// WrapConn, when set, decorates every connection before it is handed
+	// over to a peer, e.g. with the faults of a FaultInjector.
+	WrapConn func(net.Conn) net.Conn
+	// HeartbeatInterval is how often a ping is sent to every peer, so the
+	// remote node doesn't consider the connection idle. Zero sends none.
+	HeartbeatInterval time.Duration
+	// IdleTimeout is how long a peer may send nothing at all, not even a
+	// ping, before it is dropped. It should be a few HeartbeatIntervals.
+	// Zero never drops an idle peer.
+	IdleTimeout time.Duration
+	// IOTimeout is how long the handshake, any single write, or the body of
+	// a stream may stall. A stalled write drops the peer, a stalled stream
+	// is reset. Zero waits forever.
+	IOTimeout time.Duration
+	// RPCBufferSize is the number of messages of every peer that may wait on
+	// the consumer. Once that many wait, the read loop of the peer stops
+	// until the consumer catches up. Streams don't count, they are handed to
+	// the consumer right away, so the frames that steer the streams are
+	// never held up by a slow consumer. Defaults to DefaultRPCBufferSize.
+	RPCBufferSize int
+	// AwaitAccept delivers the next RPC of a peer only once the consumer
+	// called Accept on the previous one. A consumer that holds back the
+	// RPCs of a peer stops the read loop of just that peer, once
+	// RPCBufferSize of its messages wait, so its connection pushes back on
+	// it while the other peers carry on.
+	AwaitAccept bool
+	// MaxIncomingStreams is the number of streams of every peer the consumer
+	// may have open at once. A stream the peer opens beyond that is reset.
+	// Defaults to DefaultMaxIncomingStreams.
+	MaxIncomingStreams int
 }
 
 type TCPTransport struct {
 	TCPTransportOpts
 	listener net.Listener
 	rpcch    chan RPC
+
+	// closech is closed once the transport is closed, after which nothing
+	// is delivered to the consumer anymore.
+	closech   chan struct{}
+	closeOnce sync.Once
 }
 
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport {
+	if opts.RPCBufferSize == 0 {
+		opts.RPCBufferSize = DefaultRPCBufferSize
+	}
+	if opts.MaxIncomingStreams == 0 {
+		opts.MaxIncomingStreams = DefaultMaxIncomingStreams
+	}
+
 	return &TCPTransport{
 		TCPTransportOpts: opts,
-		rpcch:            make(chan RPC, 1024),
+		rpcch:            make(chan RPC, opts.RPCBufferSize),
+		closech:          make(chan struct{}),
 	}
 }
 
@@ -69,11 +274,19 @@ func (t *TCPTransport) Consume() <-chan RPC {
 	return t.rpcch
 }
 
-// Close implements the Transport interface, which will close the underlying listener.
+// Close implements the Transport interface, which will close the underlying
+// listener and the connections of all peers.
 func (t *TCPTransport) Close() error {
+	t.closeConns()
 	return t.listener.Close()
 }
 
+// closeConns closes the connections of all peers, and stops delivering what
+// they sent, as the consumer is gone.
+func (t *TCPTransport) closeConns() {
+	t.closeOnce.Do(func() { close(t.closech) })
+}
+
 // Dial implements the Transport interface, which will establish a connection to the
 // remote node.
 func (t *TCPTransport) Dial(addr string) error {
@@ -88,20 +301,25 @@ func (t *TCPTransport) Dial(addr string) error {
 }
 
 func (t *TCPTransport) ListenAndAccept() error {
-	var err error
-
-	t.listener, err = net.Listen("tcp", t.ListenAddr)
+	ln, err := net.Listen("tcp", t.ListenAddr)
 	if err != nil {
 		return err
 	}
 
-	go t.startAcceptLoop()
+	t.serve(ln)
 
 	log.Printf("TCP transport listening on port: %s\n", t.ListenAddr)
 
 	return nil
 }
 
+// serve starts accepting the connections of the given listener.
+func (t *TCPTransport) serve(ln net.Listener) {
+	t.listener = ln
+
+	go t.startAcceptLoop()
+}
+
 func (t *TCPTransport) startAcceptLoop() {
 	for {
 		conn, err := t.listener.Accept()
@@ -111,6 +329,7 @@ func (t *TCPTransport) startAcceptLoop() {
 
 		if err != nil {
 			fmt.Printf("Error TCP accepting connection: %v\n", err)
+			continue
 		}
 
 		go t.handleConn(conn, false)
@@ -118,15 +337,61 @@ func (t *TCPTransport) startAcceptLoop() {
 }
 
 func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
-	var err error
+	var (
+		err        error
+		registered bool
+	)
+
+	if t.WrapConn != nil {
+		conn = t.WrapConn(conn)
+	}
+
+	peer := NewTCPPeer(conn, outbound, t.Encoder)
+	peer.writeTimeout = t.IOTimeout
+	peer.maxIncoming = t.MaxIncomingStreams
+
+	var (
+		quitch    = make(chan struct{})
+		inbox     = newInbox(t.RPCBufferSize, t.AwaitAccept)
+		delivered = make(chan struct{})
+	)
+	go func() {
+		defer close(delivered)
+		inbox.deliver(t.rpcch, t.closech)
+	}()
+	go func() {
+		select {
+		case <-t.closech:
+			conn.Close()
+		case <-quitch:
+		}
+	}()
 
 	defer func() {
+		close(quitch)
+		if timeout := peer.err(); timeout != nil {
+			err = timeout
+		}
+		peer.closeStreams(err)
+
 		fmt.Printf("Dropping Peer connection: %s\n", err)
 		conn.Close()
-	}()
 
-	peer := NewTCPPeer(conn, outbound)
+		// Whatever was read from the peer reaches the consumer before the
+		// peer is reported to be gone.
+		inbox.close()
+		<-delivered
+
+		// Only the peers that made it through OnPeer are reported, so the
+		// consumer never hears about a peer it doesn't know.
+		if registered && t.OnPeerDisconnect != nil {
+			t.OnPeerDisconnect(peer, err)
+		}
+	}()
 
+	if t.IOTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(t.IOTimeout))
+	}
 	if err = t.HandshakeFunc(peer); err != nil {
 		return
 	}
@@ -136,25 +401,158 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 			return
 		}
 	}
+	registered = true
+
+	if t.HeartbeatInterval > 0 {
+		go t.heartbeat(peer, quitch)
+	}
 
 	// Read loop
 	for {
+		// The next frame has to arrive within the IdleTimeout, the bytes of
+		// the frame itself don't have to be faster than that.
+		var deadline time.Time
+		if t.IdleTimeout > 0 {
+			deadline = time.Now().Add(t.IdleTimeout)
+		}
+		conn.SetReadDeadline(deadline)
+
 		rpc := RPC{}
-		err = t.Decoder.Decode(conn, &rpc)
+		err = t.Decoder.Decode(peer, &rpc)
 		if err != nil {
 			return
 		}
 
 		rpc.From = conn.RemoteAddr().String()
 
-		if rpc.Stream {
-			peer.wg.Add(1)
-			fmt.Printf("[%s] incoming stream, waiting...\n", conn.RemoteAddr())
-			peer.wg.Wait()
-			fmt.Printf("[%s] stream done\n", conn.RemoteAddr())
+		switch rpc.Kind {
+		case IncomingPing:
+			// The pong is sent on its own, so the read loop never waits
+			// on a stream we are sending to the peer.
+			go peer.pong()
+			continue
+		case IncomingPong:
 			continue
+		case IncomingStream, StreamData, StreamClose, StreamWindowUpdate, StreamReset:
+			// The body of a stream is buffered in the stream, so the read
+			// loop never waits on the consumer to read it.
+			var open bool
+			if open, err = peer.demux(&rpc, t.IOTimeout); err != nil {
+				return
+			}
+			if open {
+				inbox.push(rpc)
+			}
+			continue
+		}
+
+		inbox.push(rpc)
+	}
+}
+
+// inbox holds what was read from the connection of a peer, until it is handed
+// to the consumer in the order it arrived. Pushing a message waits while the
+// inbox holds limit messages already. Pushing a stream never waits, as the
+// number of streams is bounded by the MaxIncomingStreams.
+type inbox struct {
+	limit int
+	// await makes deliver wait until the consumer accepted an RPC, before
+	// it delivers the next one.
+	await bool
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	queue    []RPC
+	messages int
+	closed   bool
+}
+
+func newInbox(limit int, await bool) *inbox {
+	b := &inbox{limit: limit, await: await}
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+func (b *inbox) push(rpc RPC) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !rpc.Stream {
+		for b.messages >= b.limit && !b.closed {
+			b.cond.Wait()
+		}
+		b.messages++
+	}
+	b.queue = append(b.queue, rpc)
+	b.cond.Broadcast()
+}
+
+// close makes deliver return once the inbox is empty.
+func (b *inbox) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+// deliver hands everything that is pushed to rpcch, until the inbox is closed
+// and empty, or until closech is closed.
+func (b *inbox) deliver(rpcch chan RPC, closech <-chan struct{}) {
+	// A push that waits on the consumer doesn't wait once deliver is gone.
+	defer b.close()
+
+	for {
+		b.lock.Lock()
+		for len(b.queue) == 0 && !b.closed {
+			b.cond.Wait()
+		}
+		if len(b.queue) == 0 {
+			b.lock.Unlock()
+			return
+		}
+		rpc := b.queue[0]
+		b.queue = b.queue[1:]
+		b.lock.Unlock()
+
+		if b.await {
+			rpc.accepted = make(chan struct{})
+		}
+		select {
+		case rpcch <- rpc:
+		case <-closech:
+			return
+		}
+		if b.await {
+			select {
+			case <-rpc.accepted:
+			case <-closech:
+				return
+			}
+		}
+
+		if !rpc.Stream {
+			b.lock.Lock()
+			b.messages--
+			b.cond.Broadcast()
+			b.lock.Unlock()
 		}
+	}
+}
+
+// heartbeat pings the peer every HeartbeatInterval, until quitch is closed.
+func (t *TCPTransport) heartbeat(peer *TCPPeer, quitch chan struct{}) {
+	ticker := time.NewTicker(t.HeartbeatInterval)
+	defer ticker.Stop()
 
-		t.rpcch <- rpc
+	for {
+		select {
+		case <-ticker.C:
+			if err := peer.ping(); err != nil {
+				return
+			}
+		case <-quitch:
+			return
+		}
 	}
 }
@@ -2,11 +2,13 @@ package p2p
 
 import (
 	"github.com/stretchr/testify/assert"
+	"io"
 	"testing"
+	"time"
 )
 
 func TestTCPTransport(t *testing.T) {
-	listenAdd := ":3000"
+	listenAdd := "127.0.0.1:0"
 
 	tcpOpts := TCPTransportOpts{
 		ListenAddr:    listenAdd,
@@ -19,4 +21,159 @@ func TestTCPTransport(t *testing.T) {
 
 	// Server
 	assert.Nil(t, tr.ListenAndAccept())
+	assert.Nil(t, tr.Close())
+}
+
+func TestTCPTransportTimeouts(t *testing.T) {
+	network := NewMemNetwork()
+
+	newTransport := func(addr string, opts TCPTransportOpts) (*MemTransport, chan Peer, chan error) {
+		opts.ListenAddr = addr
+		opts.HandshakeFunc = NOPHandshakeFunc
+		opts.Decoder = DefaultDecoder{}
+
+		tr := NewMemTransport(MemTransportOpts{TCPTransportOpts: opts, Network: network})
+		peers, reasons := make(chan Peer, 2), make(chan error, 2)
+		tr.OnPeer = func(p Peer) error {
+			peers <- p
+			return nil
+		}
+		tr.OnPeerDisconnect = func(p Peer, err error) {
+			reasons <- err
+		}
+		assert.Nil(t, tr.ListenAndAccept())
+		return tr, peers, reasons
+	}
+
+	waitReason := func(reasons chan error) error {
+		select {
+		case err := <-reasons:
+			return err
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting on the peer to be dropped")
+			return nil
+		}
+	}
+
+	timeouts := TCPTransportOpts{IdleTimeout: 100 * time.Millisecond, IOTimeout: 100 * time.Millisecond}
+	a, peersA, _ := newTransport("a", TCPTransportOpts{HeartbeatInterval: 20 * time.Millisecond})
+	b, peersB, reasonsB := newTransport("b", timeouts)
+	c, _, _ := newTransport("c", TCPTransportOpts{})
+
+	// Without heartbeats an idle peer is dropped.
+	assert.Nil(t, c.Dial("b"))
+	<-peersB
+	assert.ErrorIs(t, waitReason(reasonsB), ErrPeerTimeout)
+
+	// The heartbeats keep the connection alive, and never reach the consumer.
+	assert.Nil(t, a.Dial("b"))
+	peerA, peerB := <-peersA, <-peersB
+
+	select {
+	case err := <-reasonsB:
+		t.Fatalf("peer dropped despite the heartbeats: %s", err)
+	case rpc := <-b.Consume():
+		t.Fatalf("unexpected rpc: %+v", rpc)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// A stream of which the body stops arriving times out within the IOTimeout.
+	// The connection lives on, only the stream is reset.
+	body, w := io.Pipe()
+	defer w.Close()
+	sent := make(chan error, 1)
+	go func() {
+		_, err := peerA.SendStream([]byte("foo"), body)
+		sent <- err
+	}()
+	w.Write([]byte("bar"))
+
+	rpc := <-b.Consume()
+	assert.True(t, rpc.Stream)
+	assert.Equal(t, []byte("foo"), rpc.Payload)
+
+	buf := make([]byte, 3)
+	_, err := io.ReadFull(rpc.Body, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), buf)
+
+	_, err = rpc.Body.Read(buf)
+	assert.ErrorIs(t, err, ErrPeerTimeout)
+	assert.Nil(t, rpc.Body.Close())
+
+	// The sender stops once it hears about the reset.
+	go func() {
+		for {
+			if _, err := w.Write([]byte("baz")); err != nil {
+				return
+			}
+		}
+	}()
+	assert.ErrorIs(t, <-sent, ErrStreamReset)
+	body.Close()
+
+	assert.Nil(t, peerA.Send([]byte("foo")))
+	assert.Equal(t, []byte("foo"), (<-b.Consume()).Payload)
+	assert.Nil(t, peerB.Close())
+	assert.NotErrorIs(t, waitReason(reasonsB), ErrPeerTimeout)
+}
+
+func TestTCPTransportAwaitAccept(t *testing.T) {
+	_, b, peer, _ := muxPair(t, TCPTransportOpts{}, TCPTransportOpts{AwaitAccept: true})
+
+	assert.Nil(t, peer.Send([]byte("foo")))
+	assert.Nil(t, peer.Send([]byte("bar")))
+
+	first := <-b.Consume()
+	assert.Equal(t, []byte("foo"), first.Payload)
+
+	// The next message of the peer waits until the first one is accepted.
+	select {
+	case rpc := <-b.Consume():
+		t.Fatalf("expected no message before the first is accepted, got %q", rpc.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first.Accept()
+	select {
+	case rpc := <-b.Consume():
+		assert.Equal(t, []byte("bar"), rpc.Payload)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting on the second message")
+	}
+}
+
+func TestTCPTransportCloseWhilePeerSends(t *testing.T) {
+	reasons := make(chan error, 1)
+	opts := TCPTransportOpts{
+		RPCBufferSize: 1,
+		AwaitAccept:   true,
+		OnPeerDisconnect: func(p Peer, err error) {
+			reasons <- err
+		},
+	}
+	_, b, peer, _ := muxPair(t, TCPTransportOpts{}, opts)
+
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for peer.Send([]byte("foo")) == nil {
+		}
+	}()
+
+	// The consumer takes one message, and stops without accepting it, while
+	// the peer goes on sending.
+	<-b.Consume()
+	assert.Nil(t, b.Close())
+
+	select {
+	case <-reasons:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting on the peer to be dropped")
+	}
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting on the peer to stop sending")
+	}
 }
@@ -0,0 +1,251 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+const tlsAccepted = 0x1
+
+type TLSTransportOpts struct {
+	TCPTransportOpts
+	// CertFile and KeyFile are the PEM encoded certificate and key of this node.
+	// When they are empty, a self-signed certificate is generated for NodeID.
+	CertFile string
+	KeyFile  string
+	NodeID   string
+	// PinnedFingerprints are the SHA-256 fingerprints (hex) of the certificates of
+	// the nodes we trust. When there are none, no node is trusted.
+	PinnedFingerprints []string
+}
+
+// TLSTransport is a TCPTransport of which every connection is secured with
+// mutual TLS. The certificates are not verified against any CA, instead the
+// fingerprints of the remote certificates are pinned.
+type TLSTransport struct {
+	*TCPTransport
+
+	config      *tls.Config
+	fingerprint string
+
+	pinLock sync.RWMutex
+	pinned  map[string]bool
+}
+
+func NewTLSTransport(opts TLSTransportOpts) (*TLSTransport, error) {
+	var (
+		cert tls.Certificate
+		err  error
+	)
+	if len(opts.CertFile) > 0 || len(opts.KeyFile) > 0 {
+		cert, err = tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	} else {
+		cert, err = newSelfSignedCertificate(opts.NodeID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t := &TLSTransport{
+		fingerprint: Fingerprint(cert.Certificate[0]),
+		pinned:      make(map[string]bool),
+	}
+	for _, fp := range opts.PinnedFingerprints {
+		t.Pin(fp)
+	}
+
+	t.config = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		// The chain of the remote certificate is never verified, we check
+		// the fingerprint of the certificate in verifyPeerCertificate instead.
+		InsecureSkipVerify:    true,
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: t.verifyPeerCertificate,
+		MinVersion:            tls.VersionTLS13,
+	}
+
+	// Complete the TLS handshake before the configured one, so that one
+	// already runs over the secured connection.
+	handshake := opts.HandshakeFunc
+	if handshake == nil {
+		handshake = NOPHandshakeFunc
+	}
+	opts.HandshakeFunc = func(p Peer) error {
+		if err := tlsHandshake(p); err != nil {
+			return err
+		}
+		return handshake(p)
+	}
+
+	t.TCPTransport = NewTCPTransport(opts.TCPTransportOpts)
+
+	return t, nil
+}
+
+// Fingerprint returns the fingerprint of the certificate of this node, which
+// the other nodes have to pin.
+func (t *TLSTransport) Fingerprint() string {
+	return t.fingerprint
+}
+
+// Pin adds the fingerprint to the certificates this node trusts.
+func (t *TLSTransport) Pin(fingerprint string) {
+	t.pinLock.Lock()
+	defer t.pinLock.Unlock()
+
+	t.pinned[fingerprint] = true
+}
+
+// Dial implements the Transport interface, which will establish a TLS connection
+// to the remote node.
+func (t *TLSTransport) Dial(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go t.handleConn(tls.Client(conn, t.config), true)
+
+	return nil
+}
+
+func (t *TLSTransport) ListenAndAccept() error {
+	ln, err := net.Listen("tcp", t.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	t.serve(tls.NewListener(ln, t.config))
+
+	log.Printf("TLS transport listening on port: %s\n", t.ListenAddr)
+
+	return nil
+}
+
+func (t *TLSTransport) verifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no peer certificate")
+	}
+
+	t.pinLock.RLock()
+	defer t.pinLock.RUnlock()
+
+	if len(t.pinned) == 0 {
+		return errors.New("no certificate fingerprints are pinned")
+	}
+
+	fp := Fingerprint(rawCerts[0])
+	if !t.pinned[fp] {
+		return fmt.Errorf("peer certificate (%s) is not pinned", fp)
+	}
+	return nil
+}
+
+// tlsHandshake runs the TLS handshake of the connection of the peer, and takes
+// over the key of the remote certificate as the identity of the peer when
+// it is an Ed25519 key.
+func tlsHandshake(p Peer) error {
+	tp, ok := p.(*TCPPeer)
+	if !ok {
+		return nil
+	}
+	conn, ok := unwrapTLSConn(tp.Conn)
+	if !ok {
+		return nil
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+
+	// With TLS 1.3 the handshake of the client completes before the server has
+	// verified the client certificate. The server confirms it accepted us by
+	// sending a single byte, so a rejected client does not end up with a peer.
+	ack := []byte{tlsAccepted}
+	if tp.outbound {
+		if _, err := io.ReadFull(conn, ack); err != nil {
+			return err
+		}
+		if ack[0] != tlsAccepted {
+			return errors.New("tls connection was not accepted")
+		}
+	} else if _, err := conn.Write(ack); err != nil {
+		return err
+	}
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) > 0 {
+		if key, ok := certs[0].PublicKey.(ed25519.PublicKey); ok {
+			tp.identity = key
+		}
+	}
+
+	return nil
+}
+
+// unwrapTLSConn finds the TLS connection under the decorators of conn.
+func unwrapTLSConn(conn net.Conn) (*tls.Conn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			return c, true
+		case interface{ Unwrap() net.Conn }:
+			conn = c.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// Fingerprint returns the hex encoded SHA-256 of the DER encoded certificate.
+func Fingerprint(cert []byte) string {
+	sum := sha256.Sum256(cert)
+	return hex.EncodeToString(sum[:])
+}
+
+func newSelfSignedCertificate(nodeID string) (tls.Certificate, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: nodeID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+	}, nil
+}
@@ -0,0 +1,77 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTLSTransport(t *testing.T, nodeID string, peerch chan Peer) *TLSTransport {
+	tr, err := NewTLSTransport(TLSTransportOpts{
+		TCPTransportOpts: TCPTransportOpts{
+			ListenAddr:    "127.0.0.1:0",
+			HandshakeFunc: NOPHandshakeFunc,
+			Decoder:       DefaultDecoder{},
+			OnPeer: func(p Peer) error {
+				peerch <- p
+				return nil
+			},
+		},
+		NodeID: nodeID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func TestTLSTransport(t *testing.T) {
+	peerchA, peerchB := make(chan Peer, 1), make(chan Peer, 1)
+	a := newTestTLSTransport(t, "a", peerchA)
+	b := newTestTLSTransport(t, "b", peerchB)
+	a.Pin(b.Fingerprint())
+	b.Pin(a.Fingerprint())
+
+	assert.Nil(t, a.ListenAndAccept())
+	defer a.Close()
+
+	assert.Nil(t, b.Dial(a.listener.Addr().String()))
+
+	for _, peerch := range []chan Peer{peerchA, peerchB} {
+		select {
+		case p := <-peerch:
+			assert.NotNil(t, p.Identity())
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting on the TLS peer")
+		}
+	}
+
+	// A node with a certificate that is not pinned can not connect.
+	peerchC := make(chan Peer, 1)
+	c := newTestTLSTransport(t, "c", peerchC)
+	c.Pin(a.Fingerprint())
+	assert.Nil(t, c.Dial(a.listener.Addr().String()))
+
+	select {
+	case <-peerchA:
+		t.Fatal("expected the connection of an unpinned certificate to be dropped")
+	case <-peerchC:
+		t.Fatal("expected the connection of an unpinned certificate to be dropped")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// A node that pinned nothing trusts nobody, also when it is trusted.
+	peerchD := make(chan Peer, 1)
+	d := newTestTLSTransport(t, "d", peerchD)
+	a.Pin(d.Fingerprint())
+	assert.Nil(t, d.Dial(a.listener.Addr().String()))
+
+	select {
+	case <-peerchA:
+		t.Fatal("expected the connection of a node without pins to be dropped")
+	case <-peerchD:
+		t.Fatal("expected the connection of a node without pins to be dropped")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
@@ -1,12 +1,21 @@
 package p2p
 
-import "net"
+import (
+	"crypto/ed25519"
+	"io"
+	"net"
+)
 
 // Peer is the interface that represents the remote node.
 type Peer interface {
 	net.Conn
 	Send([]byte) error
-	CloseStream()
+	SendStream([]byte, io.Reader) (int64, error)
+	// Outbound reports whether we dialed the remote node, or it dialed us.
+	Outbound() bool
+	// Identity is the verified identity key of the remote node,
+	// or nil if the handshake did not verify one.
+	Identity() ed25519.PublicKey
 }
 
 // Transport is anything that can handles the communication
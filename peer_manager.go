@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMinReconnectBackoff = 100 * time.Millisecond
+	defaultMaxReconnectBackoff = 30 * time.Second
+)
+
+const (
+	// minPeerVouchers is the number of peers that have to advertise a node,
+	// before it is dialed again without ever having said hello to us.
+	minPeerVouchers = 2
+	// maxLearnedAttempts is the number of dials in a row that may fail, before
+	// a node that was learned through peer exchange is forgotten.
+	maxLearnedAttempts = 8
+)
+
+var errHelloTimeout = errors.New("no hello received after connecting")
+
+type peerState int
+
+const (
+	peerDisconnected peerState = iota
+	peerConnecting
+	peerConnected
+)
+
+func (s peerState) String() string {
+	switch s {
+	case peerDisconnected:
+		return "disconnected"
+	case peerConnecting:
+		return "connecting"
+	case peerConnected:
+		return "connected"
+	}
+	return fmt.Sprintf("peerState(%d)", int(s))
+}
+
+// knownPeer is a remote node, by its listen address, that we want to be
+// connected to.
+type knownPeer struct {
+	addr  string
+	state peerState
+	// connAddr is the address of the connection we have with the node,
+	// which is what the peers of the server are keyed by.
+	connAddr string
+	// attempts is the number of dials that failed in a row.
+	attempts    int
+	nextDial    time.Time
+	dialStarted time.Time
+	lastFailure error
+
+	// learned is set for a node we only heard about through peer exchange,
+	// rather than one we were configured with. Such a node is dialed once,
+	// and only dialed again when it said hello to us once, or when it is
+	// vouched for by minPeerVouchers peers.
+	learned  bool
+	hello    bool
+	vouchers map[string]bool
+}
+
+// trusted reports whether the node may be dialed again after a failed dial.
+func (p *knownPeer) trusted() bool {
+	return !p.learned || p.hello || len(p.vouchers) >= minPeerVouchers
+}
+
+// PeerStatus is a snapshot of the connection state of a known peer.
+type PeerStatus struct {
+	Addr      string
+	State     string
+	Attempts  int
+	NextDial  time.Time
+	LastError string
+}
+
+// peerManager keeps the server connected to the nodes it knows about. Every
+// node that we lose the connection with, or that we fail to dial, is dialed
+// again with an exponential backoff and jitter.
+type peerManager struct {
+	server *FileServer
+
+	lock  sync.Mutex
+	rng   *rand.Rand
+	peers map[string]*knownPeer
+}
+
+func newPeerManager(s *FileServer) *peerManager {
+	return &peerManager{
+		server: s,
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		peers:  make(map[string]*knownPeer),
+	}
+}
+
+// add makes the node at addr known to the manager, so it will be dialed.
+func (m *peerManager) add(addr string) {
+	if len(addr) == 0 || addr == m.server.Transport.Addr() {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if p, ok := m.peers[addr]; ok {
+		p.learned = false
+		return
+	}
+	m.peers[addr] = &knownPeer{addr: addr}
+}
+
+// learn makes the node at addr known to the manager, as the peer with the
+// given ID advertised it.
+func (m *peerManager) learn(addr string, from string) {
+	if len(addr) == 0 || addr == m.server.Transport.Addr() {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.peers[addr]
+	if !ok {
+		p = &knownPeer{addr: addr, learned: true, vouchers: make(map[string]bool)}
+		m.peers[addr] = p
+	}
+	if p.learned {
+		p.vouchers[from] = true
+	}
+}
+
+// connected marks the node at addr as connected over the connection with
+// connAddr, which happens once the node said hello.
+func (m *peerManager) connected(addr string, connAddr string) {
+	if len(addr) == 0 {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.peers[addr]
+	if !ok {
+		p = &knownPeer{addr: addr}
+		m.peers[addr] = p
+	}
+
+	p.state = peerConnected
+	p.connAddr = connAddr
+	p.attempts = 0
+	p.lastFailure = nil
+	p.hello = true
+}
+
+// disconnected schedules a reconnect to the node of which the connection
+// with connAddr is gone.
+func (m *peerManager) disconnected(connAddr string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, p := range m.peers {
+		if p.state == peerConnected && p.connAddr == connAddr {
+			p.state = peerDisconnected
+			p.connAddr = ""
+			p.nextDial = time.Now().Add(m.backoff(p.attempts))
+		}
+	}
+}
+
+// failed schedules the next dial of a node we failed to connect with.
+func (m *peerManager) failed(addr string, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.peers[addr]
+	if !ok || p.state == peerConnected {
+		return
+	}
+
+	m.fail(p, time.Now(), err)
+	log.Printf("[%s] failed to connect with %s (attempt %d): %s\n", m.server.Transport.Addr(), addr, p.attempts, err)
+}
+
+// fail counts the failed dial of the node, and schedules the next one. A learned
+// node that isn't trusted isn't dialed again, but it is remembered for the
+// MaxReconnectBackoff, so peer exchange doesn't have it dialed right away.
+func (m *peerManager) fail(p *knownPeer, now time.Time, err error) {
+	p.state = peerDisconnected
+	p.attempts++
+	p.lastFailure = err
+	p.nextDial = now.Add(m.backoff(p.attempts))
+	if !p.trusted() {
+		p.nextDial = now.Add(m.server.MaxReconnectBackoff)
+	}
+}
+
+// backoff returns the exponential backoff for the given number of attempts,
+// of which a random part is cut off so nodes don't all dial at once.
+func (m *peerManager) backoff(attempts int) time.Duration {
+	d := m.server.MinReconnectBackoff
+	for i := 0; i < attempts && d < m.server.MaxReconnectBackoff; i++ {
+		d *= 2
+	}
+	if d > m.server.MaxReconnectBackoff {
+		d = m.server.MaxReconnectBackoff
+	}
+
+	return d/2 + time.Duration(m.rng.Int63n(int64(d/2)+1))
+}
+
+// status returns a snapshot of the known peers.
+func (m *peerManager) status() []PeerStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	status := make([]PeerStatus, 0, len(m.peers))
+	for _, p := range m.peers {
+		ps := PeerStatus{
+			Addr:     p.addr,
+			State:    p.state.String(),
+			Attempts: p.attempts,
+			NextDial: p.nextDial,
+		}
+		if p.lastFailure != nil {
+			ps.LastError = p.lastFailure.Error()
+		}
+		status = append(status, ps)
+	}
+	return status
+}
+
+// dialable returns the known peers that are due for a dial, as long as the
+// server has less connections than its target.
+func (m *peerManager) dialable() []string {
+	s := m.server
+	connections := len(s.peerList())
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	var addrs []string
+	for _, p := range m.peers {
+		// A dial that never made it to a hello, e.g. because the handshake
+		// failed, counts as a failed attempt once the request timeout passes.
+		if p.state == peerConnecting && now.Sub(p.dialStarted) > s.RequestTimeout {
+			m.fail(p, now, errHelloTimeout)
+		}
+
+		if p.state != peerDisconnected || now.Before(p.nextDial) {
+			continue
+		}
+		// A learned node that isn't trusted, or that keeps failing, is
+		// forgotten until peer exchange hands it to us again.
+		if p.learned && ((!p.trusted() && p.attempts > 0) || p.attempts >= maxLearnedAttempts) {
+			delete(m.peers, p.addr)
+			continue
+		}
+		if s.TargetPeers > 0 && connections+len(addrs) >= s.TargetPeers {
+			continue
+		}
+
+		p.state = peerConnecting
+		p.dialStarted = now
+		addrs = append(addrs, p.addr)
+	}
+	return addrs
+}
+
+func (m *peerManager) dial(addr string) {
+	fmt.Printf("[%s] attempt to connect with remote %s\n", m.server.Transport.Addr(), addr)
+
+	if err := m.server.Transport.Dial(addr); err != nil {
+		m.failed(addr, err)
+	}
+}
+
+func (m *peerManager) loop() {
+	ticker := time.NewTicker(m.server.MinReconnectBackoff)
+	defer ticker.Stop()
+
+	for {
+		for _, addr := range m.dialable() {
+			go m.dial(addr)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-m.server.quitch:
+			return
+		}
+	}
+}
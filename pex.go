@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const defaultPeerExchangeInterval = 5 * time.Second
+
+// MessagePeerExchange asks a peer for the nodes it is connected with.
+type MessagePeerExchange struct{}
+
+// MessagePeers is the answer to a MessagePeerExchange.
+type MessagePeers struct {
+	Peers []PeerInfo
+}
+
+// PeerInfo is how a node is advertised to the others.
+type PeerInfo struct {
+	ID string
+	// ListenAddr is the configured listen address of the node, the remote
+	// address of the connection is useless to anyone but us.
+	ListenAddr string
+}
+
+// knownNodes returns every node we are connected with and got a hello from.
+func (s *FileServer) knownNodes() []PeerInfo {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	nodes := make([]PeerInfo, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		nodes = append(nodes, PeerInfo{ID: node.ID, ListenAddr: node.ListenAddr})
+	}
+	return nodes
+}
+
+func (s *FileServer) handleMessagePeerExchange(from string) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return nil
+	}
+
+	msg := Message{
+		Payload: MessagePeers{Peers: s.knownNodes()},
+	}
+	return s.send(peer, &msg)
+}
+
+// handleMessagePeers learns about the nodes the peer advertises, which vouches
+// for them with its ID.
+func (s *FileServer) handleMessagePeers(from string, msg MessagePeers) error {
+	s.peerLock.Lock()
+	node, ok := s.nodes[from]
+	s.peerLock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	for _, peer := range msg.Peers {
+		if peer.ID == s.ID || len(peer.ListenAddr) == 0 {
+			continue
+		}
+		s.peerManager.learn(peer.ListenAddr, node.ID)
+	}
+	return nil
+}
+
+// exchangePeers asks every peer for the nodes it knows about.
+func (s *FileServer) exchangePeers() {
+	msg := Message{Payload: MessagePeerExchange{}}
+	if err := s.broadcast(&msg); err != nil {
+		log.Println("peer exchange error: ", err)
+	}
+}
+
+func (s *FileServer) peerExchangeLoop() {
+	ticker := time.NewTicker(s.PeerExchangeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.exchangePeers()
+		case <-s.quitch:
+			return
+		}
+	}
+}
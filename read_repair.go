@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ZainAli104/distributed-file-system-go/p2p"
+	"io"
+	"log"
+)
+
+// MessageStatFile asks an owner which version of the file it has.
+type MessageStatFile struct {
+	ID  string
+	Key string
+}
+
+type MessageStatFileResponse struct {
+	Found bool
+	Size  int64
+	Meta  FileMeta
+}
+
+// replicaStat is what an owner told us about its replica of a file.
+type replicaStat struct {
+	owner PeerInfo
+	peer  p2p.Peer
+	MessageStatFileResponse
+}
+
+// quorumRead asks the owners of the key for the version of the file they
+// have, until ReadQuorum of them answered. The newest version is fetched from
+// one of the owners that has it, and written back in the background to the
+// owners that answered with an older version or without the file.
+func (s *FileServer) quorumRead(key string) (io.Reader, error) {
+	owners := s.remoteOwners(key)
+	if len(owners) == 0 {
+		return nil, fmt.Errorf("no owners known for file (%s)", key)
+	}
+	quorum := min(s.ReadQuorum, len(owners))
+
+	// The dead owners are not asked, but still count for the quorum.
+	owners, _ = s.liveOwners(owners)
+	peers, errs := s.dialEach(owners)
+
+	req := s.newRequest(len(peers))
+	defer s.closeRequest(req)
+
+	msg := Message{
+		RequestID: req.id,
+		Payload: MessageStatFile{
+			ID:  s.ID,
+			Key: hashKey(key),
+		},
+	}
+
+	// replicas holds the owners we are waiting on, by the address of their peer.
+	replicas := make(map[string]replicaStat)
+	for i, peer := range peers {
+		if errs[i] != nil {
+			continue
+		}
+		if s.requestPeers(req, []p2p.Peer{peer}, &msg) == 1 {
+			replicas[peer.RemoteAddr().String()] = replicaStat{owner: owners[i], peer: peer}
+		}
+	}
+
+	var stats []replicaStat
+	for len(stats) < quorum && len(replicas) > 0 {
+		resp, err := req.wait()
+		if err != nil {
+			break
+		}
+
+		stat, ok := replicas[resp.from]
+		if !ok {
+			resp.discard()
+			continue
+		}
+		delete(replicas, resp.from)
+
+		if resp.err != nil {
+			continue
+		}
+		if v, ok := resp.msg.Payload.(MessageStatFileResponse); ok {
+			stat.MessageStatFileResponse = v
+			stats = append(stats, stat)
+		}
+	}
+
+	if len(stats) < quorum {
+		return nil, fmt.Errorf("read quorum of file (%s) not reached: %d of %d owners answered", key, len(stats), quorum)
+	}
+
+	newest, ok := newestReplica(stats)
+	if !ok {
+		return nil, fmt.Errorf("file (%s) not found on any of its owners", key)
+	}
+
+	var holders, stale []replicaStat
+	for _, stat := range stats {
+		switch {
+		case newest.Deleted:
+			if !stat.Meta.Deleted {
+				stale = append(stale, stat)
+			}
+		case stat.Found && stat.Meta.Version == newest.Version && bytes.Equal(stat.Meta.Checksum, newest.Checksum):
+			holders = append(holders, stat)
+		default:
+			stale = append(stale, stat)
+		}
+	}
+
+	// The newest version is a tombstone, so the owners that still have the
+	// file missed the delete.
+	if newest.Deleted {
+		if len(stale) > 0 {
+			go s.repair(key, newest, replicaChunks{}, stale)
+		}
+		return nil, fmt.Errorf("file (%s): %w", key, errFileDeleted)
+	}
+
+	holderPeers := make([]p2p.Peer, len(holders))
+	for i, stat := range holders {
+		holderPeers[i] = stat.peer
+	}
+
+	r, chunks, err := s.fetch(key, holderPeers, newest.Checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(stale) > 0 {
+		go s.repair(key, newest, chunks, stale)
+	}
+
+	return r, nil
+}
+
+// newestReplica returns the metadata of the newest version of the file,
+// which is a tombstone if the file is deleted. Owners with the same version
+// normally agree on its checksum, when they don't the checksum of most of
+// them wins.
+func newestReplica(stats []replicaStat) (FileMeta, bool) {
+	var (
+		newest FileMeta
+		found  bool
+	)
+	for _, stat := range stats {
+		if (stat.Found || stat.Meta.Deleted) && (!found || stat.Meta.Version > newest.Version) {
+			newest, found = stat.Meta, true
+		}
+	}
+	if newest.Deleted {
+		return newest, true
+	}
+
+	var (
+		votes = make(map[string]int)
+		best  = 0
+	)
+	for _, stat := range stats {
+		if !stat.Found || stat.Meta.Version != newest.Version {
+			continue
+		}
+
+		checksum := string(stat.Meta.Checksum)
+		votes[checksum]++
+		if votes[checksum] > best {
+			best, newest = votes[checksum], stat.Meta
+		}
+	}
+	return newest, found
+}
+
+// repair writes the newest version of the file to the owners that have an
+// older version of it, or none at all. When the newest version is a
+// tombstone, the file is deleted from those owners instead.
+func (s *FileServer) repair(key string, meta FileMeta, chunks replicaChunks, stale []replicaStat) {
+	for _, stat := range stale {
+		var err error
+		if meta.Deleted {
+			err = s.repairDelete(key, meta, stat.peer)
+		} else {
+			// The owner only needs the chunks that changed since its version.
+			_, err = s.pushReplica(stat.peer, s.ID, hashKey(key), meta, chunks, nil)
+		}
+		if err != nil {
+			log.Printf("[%s] failed to repair file (%s) on %s: %s\n", s.Transport.Addr(), key, stat.owner.ListenAddr, err)
+			continue
+		}
+		fmt.Printf("[%s] repaired file (%s) on %s\n", s.Transport.Addr(), key, stat.owner.ListenAddr)
+	}
+}
+
+// repairDelete writes the tombstone of the file to the owner on the other end
+// of the peer.
+func (s *FileServer) repairDelete(key string, meta FileMeta, peer p2p.Peer) error {
+	req := s.newRequest(1)
+	defer s.closeRequest(req)
+
+	s.expect(req, peer.RemoteAddr().String())
+
+	msg := Message{
+		RequestID: req.id,
+		Payload: MessageDeleteFile{
+			ID:      s.ID,
+			Key:     hashKey(key),
+			Version: meta.Version,
+		},
+	}
+	if err := s.send(peer, &msg); err != nil {
+		return err
+	}
+
+	resp, err := req.wait()
+	if err != nil {
+		return err
+	}
+	return checkDeleteAck(resp)
+}
+
+func (s *FileServer) handleMessageStatFile(from string, requestID uint64, msg MessageStatFile) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer not found: %s", from)
+	}
+
+	var stat MessageStatFileResponse
+	if s.store.Has(msg.ID, msg.Key) {
+		size, r, err := s.store.Read(msg.ID, msg.Key)
+		if err != nil {
+			return err
+		}
+		if rc, ok := r.(io.ReadCloser); ok {
+			rc.Close()
+		}
+
+		meta, err := s.store.ReadMeta(msg.ID, msg.Key)
+		if err != nil {
+			return err
+		}
+
+		stat = MessageStatFileResponse{Found: true, Size: size, Meta: meta}
+	} else if meta, err := s.store.ReadMeta(msg.ID, msg.Key); err == nil && meta.Deleted {
+		stat.Meta = meta
+	}
+
+	resp := Message{
+		RequestID: requestID,
+		Payload:   stat,
+	}
+	return s.send(peer, &resp)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rateLimiter spreads the reads of all its readers over time, so together
+// they read no more than rate bytes per second. A nil rateLimiter doesn't
+// limit anything.
+type rateLimiter struct {
+	rate int64
+
+	lock sync.Mutex
+	// next is when the bytes that were read so far are paid off.
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate}
+}
+
+// wait blocks until the n bytes that were read fit within the rate.
+func (l *rateLimiter) wait(n int) {
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.lock.Unlock()
+
+	time.Sleep(delay)
+}
+
+func (l *rateLimiter) reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r: r, limiter: l}
+}
+
+type limitedReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	// Read at most a tenth of a second worth of bytes at once, so the
+	// bytes are spread evenly.
+	if max := r.limiter.rate/10 + 1; int64(len(p)) > max {
+		p = p[:max]
+	}
+
+	n, err := r.r.Read(p)
+	r.limiter.wait(n)
+	return n, err
+}
+
+// RebalanceStatus is the progress of moving the replicas of the keys a node
+// that joined took over to it.
+type RebalanceStatus struct {
+	// Node is the listen address of the node that joined.
+	Node    string
+	Started time.Time
+	// Total is the number of replicas to move, of which Moved are on the
+	// node now and Failed could not be moved.
+	Total  int
+	Moved  int
+	Failed int
+	// Bytes is the number of bytes that were sent to the node. Replicas the
+	// node already had are moved without sending them.
+	Bytes int64
+	// Removed is the number of replicas we no longer own, which were deleted
+	// once the node confirmed it stored them.
+	Removed int
+	Done    bool
+}
+
+// Rebalances returns the progress of moving replicas to the nodes that joined,
+// of every join that had any replicas for us to move.
+func (s *FileServer) Rebalances() []RebalanceStatus {
+	s.rebalanceLock.Lock()
+	defer s.rebalanceLock.Unlock()
+
+	status := make([]RebalanceStatus, 0, len(s.rebalances))
+	for _, rebalance := range s.rebalances {
+		status = append(status, *rebalance)
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Started.Before(status[j].Started)
+	})
+	return status
+}
+
+// updateRebalance changes the progress of the rebalance to the node.
+func (s *FileServer) updateRebalance(node PeerInfo, update func(*RebalanceStatus)) {
+	s.rebalanceLock.Lock()
+	defer s.rebalanceLock.Unlock()
+
+	update(s.rebalances[node.ID])
+}
+
+// rebalance moves our replicas of the files the node that joined owns now to
+// it. Once the node stored a replica, ours is deleted if we are no longer one
+// of its owners. Tombstones are left to the anti-entropy.
+func (s *FileServer) rebalance(node PeerInfo) {
+	entries, err := s.store.Entries()
+	if err != nil {
+		log.Printf("[%s] failed to list the store: %s\n", s.Transport.Addr(), err)
+		return
+	}
+
+	var moves []StoreEntry
+	for _, e := range entries {
+		if e.Deleted || !s.owns(node.ID, e.Key) {
+			continue
+		}
+		moves = append(moves, e)
+	}
+	if len(moves) == 0 {
+		return
+	}
+
+	s.rebalanceLock.Lock()
+	if rebalance, ok := s.rebalances[node.ID]; ok && !rebalance.Done {
+		s.rebalanceLock.Unlock()
+		return
+	}
+	s.rebalances[node.ID] = &RebalanceStatus{
+		Node:    node.ListenAddr,
+		Started: time.Now(),
+		Total:   len(moves),
+	}
+	s.rebalanceLock.Unlock()
+
+	log.Printf("[%s] moving %d replicas to %s\n", s.Transport.Addr(), len(moves), node.ListenAddr)
+
+	for _, e := range moves {
+		n, err := s.copyReplica(node, e)
+		if err != nil {
+			log.Printf("[%s] failed to move file (%x) to %s: %s\n", s.Transport.Addr(), e.Key, node.ListenAddr, err)
+			s.updateRebalance(node, func(status *RebalanceStatus) { status.Failed++ })
+			continue
+		}
+
+		removed := false
+		if !s.owns(s.ID, e.Key) {
+			if err := s.store.Delete(e.ID, e.Key); err != nil {
+				log.Printf("[%s] failed to delete surplus replica of file (%x): %s\n", s.Transport.Addr(), e.Key, err)
+			} else {
+				removed = true
+			}
+		}
+
+		s.updateRebalance(node, func(status *RebalanceStatus) {
+			status.Moved++
+			status.Bytes += n
+			if removed {
+				status.Removed++
+			}
+		})
+	}
+
+	s.updateRebalance(node, func(status *RebalanceStatus) { status.Done = true })
+	log.Printf("[%s] done moving replicas to %s\n", s.Transport.Addr(), node.ListenAddr)
+}
+
+// owns reports whether the node with the given ID is one of the owners of the
+// hashed key.
+func (s *FileServer) owns(id string, hashedKey string) bool {
+	for _, owner := range s.ring().owners(hashedKey, s.ReplicationFactor) {
+		if owner.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(1000)
+	data := make([]byte, 300)
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, limiter.reader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("expected %d bytes, got %d", len(data), n)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("expected reading 300 bytes at 1000 bytes per second to take 300ms, took %s", elapsed)
+	}
+
+	r := bytes.NewReader(data)
+	if newRateLimiter(0).reader(r) != io.Reader(r) {
+		t.Error("expected no limit without a rate")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ZainAli104/distributed-file-system-go/p2p"
+	"io"
+	"log"
+	"time"
+)
+
+const defaultRequestTimeout = 5 * time.Second
+
+var errPeerDisconnected = errors.New("peer disconnected")
+
+// response is a reply from a peer to one of our pending requests.
+type response struct {
+	from string
+	msg  *Message
+	// body is only set when the response is the header of a stream, and has
+	// to be closed once it has been read.
+	body io.ReadCloser
+	// err is set instead of msg when the peer will never respond, because
+	// its connection is gone.
+	err error
+}
+
+// discard drops the body of a stream response, so the peer stops sending it.
+func (r response) discard() {
+	if r.body != nil {
+		r.body.Close()
+	}
+}
+
+// pendingRequest is a request we've sent to one or more peers and for which
+// we are waiting on responses until the deadline passes.
+type pendingRequest struct {
+	id       uint64
+	deadline time.Time
+	respch   chan response
+	// waiting holds the addresses of the peers of which we still expect
+	// a response, guarded by the pendingLock of the server.
+	waiting map[string]bool
+}
+
+// wait blocks until the next response for the request arrives or the deadline
+// of the request has passed.
+func (r *pendingRequest) wait() (response, error) {
+	timer := time.NewTimer(time.Until(r.deadline))
+	defer timer.Stop()
+
+	select {
+	case resp := <-r.respch:
+		return resp, nil
+	case <-timer.C:
+		return response{}, fmt.Errorf("request (%d) timed out", r.id)
+	}
+}
+
+// newRequest registers a new pending request which expects at most n responses.
+func (s *FileServer) newRequest(n int) *pendingRequest {
+	req := &pendingRequest{
+		id:       s.lastRequestID.Add(1),
+		deadline: time.Now().Add(s.RequestTimeout),
+		respch:   make(chan response, n),
+		waiting:  make(map[string]bool),
+	}
+
+	s.pendingLock.Lock()
+	s.pending[req.id] = req
+	s.pendingLock.Unlock()
+
+	return req
+}
+
+// expect marks that the request waits on a response of the given peer. It has
+// to be called before the request is sent, and undone with unexpect when
+// sending it failed.
+func (s *FileServer) expect(req *pendingRequest, addr string) {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+
+	req.waiting[addr] = true
+}
+
+func (s *FileServer) unexpect(req *pendingRequest, addr string) {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+
+	delete(req.waiting, addr)
+}
+
+// requestPeers sends msg to each of the peers, and reports how many of them
+// it was sent to. A peer for which sending fails is skipped.
+func (s *FileServer) requestPeers(req *pendingRequest, peers []p2p.Peer, msg *Message) int {
+	b, err := encodeMessage(msg)
+	if err != nil {
+		log.Println("encoding error: ", err)
+		return 0
+	}
+
+	sent := 0
+	for _, peer := range peers {
+		addr := peer.RemoteAddr().String()
+		s.expect(req, addr)
+		if err := peer.Send(b); err != nil {
+			log.Printf("[%s] failed to send request to %s: %s\n", s.Transport.Addr(), addr, err)
+			s.unexpect(req, addr)
+			continue
+		}
+		sent++
+	}
+	return sent
+}
+
+// closeRequest removes the request from the pending table. Responses that were
+// delivered but never consumed are discarded, and the ones arriving later on
+// will not find the request anymore.
+func (s *FileServer) closeRequest(req *pendingRequest) {
+	s.pendingLock.Lock()
+	delete(s.pending, req.id)
+	s.pendingLock.Unlock()
+
+	for {
+		select {
+		case resp := <-req.respch:
+			resp.discard()
+		default:
+			return
+		}
+	}
+}
+
+// deliver hands the response over to the pending request with the given ID.
+// It reports false if there is no such request (anymore), or if the request
+// does not wait on a response from that peer.
+func (s *FileServer) deliver(id uint64, resp response) bool {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+
+	req, ok := s.pending[id]
+	if !ok || !req.waiting[resp.from] {
+		return false
+	}
+
+	select {
+	case req.respch <- resp:
+		delete(req.waiting, resp.from)
+		return true
+	default:
+		return false
+	}
+}
+
+// failPending hands an error response over to every pending request that
+// still waits on the given peer, so they don't have to wait on the deadline.
+func (s *FileServer) failPending(addr string, err error) {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+
+	for _, req := range s.pending {
+		if !req.waiting[addr] {
+			continue
+		}
+
+		select {
+		case req.respch <- response{from: addr, err: err}:
+			delete(req.waiting, addr)
+		default:
+		}
+	}
+}
+
+func (s *FileServer) handleResponse(from string, body io.ReadCloser, msg *Message) error {
+	resp := response{from: from, msg: msg, body: body}
+
+	if !s.deliver(msg.RequestID, resp) {
+		log.Printf("[%s] dropping response for unknown request (%d) from %s\n", s.Transport.Addr(), msg.RequestID, from)
+		resp.discard()
+	}
+
+	return nil
+}
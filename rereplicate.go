@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const defaultReplicationGracePeriod = time.Minute
+
+// departure is when a member was declared dead.
+type departure struct {
+	node PeerInfo
+	at   time.Time
+}
+
+func (s *FileServer) departureLoop() {
+	ticker := time.NewTicker(s.ReplicationGracePeriod / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.checkDepartures(s.ReplicationGracePeriod)
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// checkDepartures removes the nodes that are gone for longer than the grace
+// period from the ring, and copies the replicas they owned to the nodes that
+// took over their keys.
+func (s *FileServer) checkDepartures(grace time.Duration) {
+	var left []PeerInfo
+
+	s.peerLock.Lock()
+	for id, d := range s.departures {
+		if time.Since(d.at) >= grace {
+			left = append(left, d.node)
+			delete(s.departures, id)
+		}
+	}
+	s.peerLock.Unlock()
+
+	for _, node := range left {
+		log.Printf("[%s] node %s left the cluster, re-replicating its files\n", s.Transport.Addr(), node.ListenAddr)
+		s.routes.remove(node.ID)
+		s.rereplicate(node)
+	}
+}
+
+// rereplicate copies the replicas we own of the files the node that left
+// owned to their new owners. Every owner that is left does the same, the
+// replicas a new owner already has are skipped. Tombstones are left to the
+// anti-entropy.
+func (s *FileServer) rereplicate(left PeerInfo) {
+	entries, err := s.store.Entries()
+	if err != nil {
+		log.Printf("[%s] failed to list the store: %s\n", s.Transport.Addr(), err)
+		return
+	}
+
+	var (
+		ring   = s.ring()
+		before = newHashRing(append(s.members(), left), s.VirtualNodes)
+	)
+	for _, e := range entries {
+		if e.Deleted {
+			continue
+		}
+
+		previous := make(map[string]bool)
+		for _, owner := range before.owners(e.Key, s.ReplicationFactor) {
+			previous[owner.ID] = true
+		}
+		if !previous[left.ID] {
+			continue
+		}
+
+		owners := ring.owners(e.Key, s.ReplicationFactor)
+		var ours bool
+		for _, owner := range owners {
+			ours = ours || owner.ID == s.ID
+		}
+		if !ours {
+			continue
+		}
+
+		// The owners that were owners before have the replica already.
+		for _, owner := range owners {
+			if previous[owner.ID] || owner.ID == s.ID {
+				continue
+			}
+			if _, err := s.copyReplica(owner, e); err != nil {
+				log.Printf("[%s] failed to re-replicate file (%x) to %s: %s\n", s.Transport.Addr(), e.Key, owner.ListenAddr, err)
+			}
+		}
+	}
+}
+
+// copyReplica streams our replica of the entry to the owner, within the
+// RebalanceBandwidth, unless the owner already has it or a newer version. It
+// returns the number of bytes that were sent, which is only the chunks the
+// owner didn't have yet.
+func (s *FileServer) copyReplica(owner PeerInfo, e StoreEntry) (int64, error) {
+	msg, err := s.call(owner, MessageStatFile{ID: e.ID, Key: e.Key})
+	if err != nil {
+		return 0, err
+	}
+	stat, ok := msg.Payload.(MessageStatFileResponse)
+	if !ok {
+		return 0, fmt.Errorf("unexpected response: %T", msg.Payload)
+	}
+	if (stat.Found || stat.Meta.Deleted) && stat.Meta.Version >= e.Version {
+		return 0, nil
+	}
+
+	peer, err := s.dialNode(owner)
+	if err != nil {
+		return 0, err
+	}
+
+	chunks, err := s.storedChunks(e.ID, e.Key)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := s.pushReplica(peer, e.ID, e.Key, e.FileMeta, chunks, s.limiter)
+	if err != nil {
+		return n, err
+	}
+
+	fmt.Printf("[%s] copied file (%x) to %s\n", s.Transport.Addr(), e.Key, owner.ListenAddr)
+	return n, nil
+}
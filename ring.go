@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultReplicationFactor = 3
+	defaultVirtualNodes      = 100
+)
+
+// ringPoint is one of the virtual nodes of a node on the hash ring.
+type ringPoint struct {
+	hash uint64
+	node PeerInfo
+}
+
+// hashRing is a consistent-hash ring on which every node is placed a number
+// of times, its virtual nodes, so the keys are spread evenly and only a small
+// part of them move when a node joins or leaves.
+type hashRing struct {
+	points []ringPoint
+}
+
+func ringHash(s string) uint64 {
+	hash := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(hash[:8])
+}
+
+func newHashRing(nodes []PeerInfo, vnodes int) *hashRing {
+	r := &hashRing{
+		points: make([]ringPoint, 0, len(nodes)*vnodes),
+	}
+	for _, node := range nodes {
+		for i := 0; i < vnodes; i++ {
+			r.points = append(r.points, ringPoint{
+				hash: ringHash(fmt.Sprintf("%s#%d", node.ID, i)),
+				node: node,
+			})
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+// owners returns the first n distinct nodes that follow the hashed key on the ring.
+func (r *hashRing) owners(hashedKey string, n int) []PeerInfo {
+	if len(r.points) == 0 {
+		return nil
+	}
+
+	hash := ringHash(hashedKey)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+
+	var (
+		owners []PeerInfo
+		seen   = make(map[string]bool)
+	)
+	for i := 0; i < len(r.points) && len(owners) < n; i++ {
+		node := r.points[(start+i)%len(r.points)].node
+		if !seen[node.ID] {
+			seen[node.ID] = true
+			owners = append(owners, node)
+		}
+	}
+	return owners
+}
+
+// ringCache holds the ring of the last membership it was built for, so it
+// is only built again when the membership changes.
+type ringCache struct {
+	lock    sync.Mutex
+	members string
+	ring    *hashRing
+}
+
+// members returns every node the server knows about, including itself,
+// ordered by ID. Dead members are left out, unless they are still in the
+// routing table, from which they are removed once they are gone for the
+// ReplicationGracePeriod.
+func (s *FileServer) members() []PeerInfo {
+	nodes := map[string]PeerInfo{
+		s.ID: {ID: s.ID, ListenAddr: s.Transport.Addr()},
+	}
+	for _, m := range s.Members() {
+		if m.State != MemberDead {
+			nodes[m.ID] = PeerInfo{ID: m.ID, ListenAddr: m.ListenAddr}
+		}
+	}
+	for _, node := range s.knownNodes() {
+		nodes[node.ID] = node
+	}
+	for _, node := range s.routes.contacts() {
+		nodes[node.ID] = node
+	}
+
+	members := make([]PeerInfo, 0, len(nodes))
+	for _, node := range nodes {
+		members = append(members, node)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+	return members
+}
+
+func (s *FileServer) ring() *hashRing {
+	members := s.members()
+
+	ids := make([]string, len(members))
+	for i, node := range members {
+		ids[i] = node.ID
+	}
+	key := strings.Join(ids, ",")
+
+	s.ringCache.lock.Lock()
+	defer s.ringCache.lock.Unlock()
+
+	if s.ringCache.ring == nil || s.ringCache.members != key {
+		s.ringCache.members = key
+		s.ringCache.ring = newHashRing(members, s.VirtualNodes)
+	}
+	return s.ringCache.ring
+}
+
+// Owners returns the nodes that own the key, which are the ReplicationFactor
+// nodes that follow it on the hash ring of the nodes the server knows about.
+func (s *FileServer) Owners(key string) []PeerInfo {
+	return s.ring().owners(hashKey(key), s.ReplicationFactor)
+}
+
+// remoteOwners returns the owners of the key, without the server itself.
+func (s *FileServer) remoteOwners(key string) []PeerInfo {
+	var owners []PeerInfo
+	for _, node := range s.Owners(key) {
+		if node.ID != s.ID {
+			owners = append(owners, node)
+		}
+	}
+	return owners
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashRingOwners(t *testing.T) {
+	var nodes []PeerInfo
+	for i := 0; i < 10; i++ {
+		nodes = append(nodes, PeerInfo{ID: generateID(), ListenAddr: fmt.Sprintf("node_%d", i)})
+	}
+	ring := newHashRing(nodes, defaultVirtualNodes)
+
+	owners := ring.owners(hashKey("foo"), 3)
+	if len(owners) != 3 {
+		t.Fatalf("expected 3 owners, got %d", len(owners))
+	}
+	if owners[0].ID == owners[1].ID || owners[0].ID == owners[2].ID || owners[1].ID == owners[2].ID {
+		t.Errorf("expected distinct owners, got %v", owners)
+	}
+
+	if owners := ring.owners(hashKey("foo"), 20); len(owners) != len(nodes) {
+		t.Errorf("expected every node to own the key, got %d owners", len(owners))
+	}
+}
+
+func TestHashRingMovesFewKeys(t *testing.T) {
+	var nodes []PeerInfo
+	for i := 0; i < 10; i++ {
+		nodes = append(nodes, PeerInfo{ID: generateID()})
+	}
+	before := newHashRing(nodes, defaultVirtualNodes)
+	after := newHashRing(append(nodes, PeerInfo{ID: generateID()}), defaultVirtualNodes)
+
+	// Only the keys the new node takes over move, which should be about
+	// one in eleven of them.
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := hashKey(fmt.Sprintf("key_%d", i))
+		if before.owners(key, 1)[0].ID != after.owners(key, 1)[0].ID {
+			moved++
+		}
+	}
+	if moved > 250 {
+		t.Errorf("expected about 90 of 1000 keys to move, %d did", moved)
+	}
+}
@@ -2,13 +2,18 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"crypto/sha256"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"github.com/ZainAli104/distributed-file-system-go/p2p"
 	"io"
 	"log"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,6 +24,82 @@ type FileServerOpts struct {
 	PathTransformFunc
 	Transport      p2p.Transport
 	BootstrapNodes []string
+	// RequestTimeout is how long we wait on the responses of the peers
+	// for a single request, defaults to defaultRequestTimeout.
+	RequestTimeout time.Duration
+	// TargetPeers is the number of connections the server tries to keep up,
+	// zero means it connects with every node it knows about.
+	TargetPeers int
+	// MinReconnectBackoff and MaxReconnectBackoff bound the exponential backoff
+	// between the dials of a node we are not connected with.
+	MinReconnectBackoff time.Duration
+	MaxReconnectBackoff time.Duration
+	// PeerExchangeInterval is how often the peers are asked for the nodes
+	// they know about, defaults to defaultPeerExchangeInterval.
+	PeerExchangeInterval time.Duration
+	// BucketSize is the k of the DHT: the size of the buckets of the routing
+	// table, and the number of nodes a lookup returns. Defaults to
+	// defaultBucketSize.
+	BucketSize int
+	// LookupConcurrency is the number of nodes a DHT lookup queries at once,
+	// defaults to defaultLookupConcurrency.
+	LookupConcurrency int
+	// ReplicationFactor is the number of nodes every file is stored on,
+	// defaults to defaultReplicationFactor.
+	ReplicationFactor int
+	// VirtualNodes is the number of times every node is placed on the hash
+	// ring, defaults to defaultVirtualNodes.
+	VirtualNodes int
+	// WriteQuorum is the number of owners, ourselves included, that have to
+	// acknowledge a file before Store succeeds. It defaults to a majority of
+	// the ReplicationFactor, and is capped at the number of owners there are.
+	WriteQuorum int
+	// ReadQuorum is the number of owners that are asked which version of a
+	// file they have on a Get, it defaults to a majority of the
+	// ReplicationFactor and is capped at the number of owners there are.
+	ReadQuorum int
+	// AntiEntropyInterval is how often the replicas are synchronized with
+	// the other owners, defaults to defaultAntiEntropyInterval.
+	AntiEntropyInterval time.Duration
+	// ReplicationGracePeriod is how long a node can be gone before it is
+	// removed from the ring and its files are copied to the nodes that take
+	// over its keys. Defaults to defaultReplicationGracePeriod.
+	ReplicationGracePeriod time.Duration
+	// RebalanceBandwidth is the number of bytes per second that may be used
+	// to copy replicas to the nodes that took over their keys, when nodes
+	// join or leave. Zero means no limit.
+	RebalanceBandwidth int64
+	// ProbeInterval is how often a member is probed by the SWIM failure
+	// detector, defaults to defaultProbeInterval.
+	ProbeInterval time.Duration
+	// ProbeTimeout is how long a probed member has to answer, defaults to
+	// defaultProbeTimeout.
+	ProbeTimeout time.Duration
+	// IndirectProbes is the number of members that are asked to probe a
+	// member that didn't answer, defaults to defaultIndirectProbes.
+	IndirectProbes int
+	// SuspicionTimeout is how long a suspected member has to refute the
+	// suspicion before it is declared dead, defaults to
+	// defaultSuspicionTimeout.
+	SuspicionTimeout time.Duration
+	// Workers is the number of messages that are handled at once, defaults
+	// to defaultWorkers.
+	Workers int
+	// QueueSize is the number of messages of a single peer that may wait on
+	// a worker or be handled. Once a peer has that many, no more of its
+	// messages are taken from the transport until it has fewer, so only that
+	// peer has to slow down. That takes a transport with AwaitAccept set.
+	// Defaults to defaultQueueSize.
+	QueueSize int
+	// GarbageCollectInterval is how often the chunks that are no longer part
+	// of any file are removed, defaults to defaultGarbageCollectInterval.
+	GarbageCollectInterval time.Duration
+}
+
+// remoteNode is what a node told us about itself in its hello.
+type remoteNode struct {
+	ID         string
+	ListenAddr string
 }
 
 type FileServer struct {
@@ -26,8 +107,35 @@ type FileServer struct {
 
 	peerLock sync.Mutex
 	peers    map[string]p2p.Peer
-
-	store  *Store
+	// nodes holds what the peers told us about themselves in their hello,
+	// keyed by the same address as the peers.
+	nodes map[string]remoteNode
+	// departures holds the members that were declared dead, by their ID.
+	departures  map[string]departure
+	memberList  *memberList
+	peerManager *peerManager
+	// helloWaiters are closed once the node with that ID said hello.
+	helloWaiters map[string][]chan struct{}
+	routes       *routingTable
+	ringCache    ringCache
+
+	// limiter limits the bandwidth of the replicas that are copied to new owners.
+	limiter       *rateLimiter
+	rebalanceLock sync.Mutex
+	rebalances    map[string]*RebalanceStatus
+
+	lastRequestID atomic.Uint64
+	pendingLock   sync.Mutex
+	pending       map[uint64]*pendingRequest
+	// workers handle the messages of the peers, and probeWorkers their
+	// pings.
+	workers      *workerPool
+	probeWorkers *workerPool
+
+	store *Store
+	// hints holds the replicas of the owners that were down when we stored
+	// a file.
+	hints  *hintStore
 	quitch chan struct{}
 }
 
@@ -40,40 +148,182 @@ func NewFileServer(opts FileServerOpts) *FileServer {
 	if len(opts.ID) == 0 {
 		opts.ID = generateID()
 	}
+	if opts.RequestTimeout == 0 {
+		opts.RequestTimeout = defaultRequestTimeout
+	}
+	if opts.MinReconnectBackoff == 0 {
+		opts.MinReconnectBackoff = defaultMinReconnectBackoff
+	}
+	if opts.MaxReconnectBackoff == 0 {
+		opts.MaxReconnectBackoff = defaultMaxReconnectBackoff
+	}
+	if opts.PeerExchangeInterval == 0 {
+		opts.PeerExchangeInterval = defaultPeerExchangeInterval
+	}
+	if opts.BucketSize == 0 {
+		opts.BucketSize = defaultBucketSize
+	}
+	if opts.LookupConcurrency == 0 {
+		opts.LookupConcurrency = defaultLookupConcurrency
+	}
+	if opts.ReplicationFactor == 0 {
+		opts.ReplicationFactor = defaultReplicationFactor
+	}
+	if opts.VirtualNodes == 0 {
+		opts.VirtualNodes = defaultVirtualNodes
+	}
+	if opts.WriteQuorum == 0 {
+		opts.WriteQuorum = opts.ReplicationFactor/2 + 1
+	}
+	if opts.ReadQuorum == 0 {
+		opts.ReadQuorum = opts.ReplicationFactor/2 + 1
+	}
+	if opts.AntiEntropyInterval == 0 {
+		opts.AntiEntropyInterval = defaultAntiEntropyInterval
+	}
+	if opts.ReplicationGracePeriod == 0 {
+		opts.ReplicationGracePeriod = defaultReplicationGracePeriod
+	}
+	if opts.ProbeInterval == 0 {
+		opts.ProbeInterval = defaultProbeInterval
+	}
+	if opts.ProbeTimeout == 0 {
+		opts.ProbeTimeout = defaultProbeTimeout
+	}
+	if opts.IndirectProbes == 0 {
+		opts.IndirectProbes = defaultIndirectProbes
+	}
+	if opts.SuspicionTimeout == 0 {
+		opts.SuspicionTimeout = defaultSuspicionTimeout
+	}
+	if opts.Workers == 0 {
+		opts.Workers = defaultWorkers
+	}
+	if opts.QueueSize == 0 {
+		opts.QueueSize = defaultQueueSize
+	}
+	if opts.GarbageCollectInterval == 0 {
+		opts.GarbageCollectInterval = defaultGarbageCollectInterval
+	}
 
-	return &FileServer{
+	s := &FileServer{
 		FileServerOpts: opts,
 		store:          NewStore(storeOpts),
 		quitch:         make(chan struct{}),
 		peers:          make(map[string]p2p.Peer),
+		nodes:          make(map[string]remoteNode),
+		departures:     make(map[string]departure),
+		memberList:     newMemberList(PeerInfo{ID: opts.ID, ListenAddr: opts.Transport.Addr()}),
+		helloWaiters:   make(map[string][]chan struct{}),
+		routes:         newRoutingTable(opts.ID, opts.BucketSize),
+		limiter:        newRateLimiter(opts.RebalanceBandwidth),
+		rebalances:     make(map[string]*RebalanceStatus),
+		pending:        make(map[uint64]*pendingRequest),
+		workers:        newWorkerPool(opts.Transport.Addr(), opts.Workers, opts.QueueSize),
+		probeWorkers:   newWorkerPool(opts.Transport.Addr(), defaultProbeWorkers, defaultProbeQueueSize),
 	}
+	s.hints = newHintStore(s.store.Root + "/hints")
+	s.peerManager = newPeerManager(s)
+
+	return s
 }
 
-func (s *FileServer) broadcast(msg *Message) error {
+func encodeMessage(msg *Message) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *FileServer) send(peer p2p.Peer, msg *Message) error {
+	b, err := encodeMessage(msg)
+	if err != nil {
 		return err
 	}
+	return peer.Send(b)
+}
 
-	for _, peer := range s.peers {
-		peer.Send([]byte{p2p.IncomingMessage})
-		if err := peer.Send(buf.Bytes()); err != nil {
+// sendStream sends msg as the header of a stream to the peer, followed by
+// everything that is read from body.
+func (s *FileServer) sendStream(peer p2p.Peer, msg *Message, body io.Reader) (int64, error) {
+	b, err := encodeMessage(msg)
+	if err != nil {
+		return 0, err
+	}
+	return peer.SendStream(b, body)
+}
+
+func (s *FileServer) broadcast(msg *Message) error {
+	b, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	// A peer that can't be reached is skipped, its connection is about to be
+	// dropped and it will be removed from the peers by OnPeerDisconnect.
+	for _, peer := range s.peerList() {
+		if err := peer.Send(b); err != nil {
 			log.Println("Failed to send message to peer: ", err)
-			return err
 		}
 	}
 
 	return nil
 }
 
+func (s *FileServer) peer(addr string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peer, ok := s.peers[addr]
+	return peer, ok
+}
+
+func (s *FileServer) peerList() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
 type Message struct {
-	Payload any
+	// RequestID correlates a response with the request it answers. Responses
+	// always carry the RequestID of the request they were sent for.
+	RequestID uint64
+	Payload   any
+}
+
+// MessageHello is the first message a node sends over every connection.
+type MessageHello struct {
+	ID string
+	// ListenAddr is the address the node can be dialed on, which is not
+	// the remote address of the connection for the peers that dialed us.
+	ListenAddr string
 }
 
 type MessageStoreFile struct {
 	ID   string
 	Key  string
 	Size int64
+	// Version orders the writes of the file, an owner never replaces its
+	// replica with an older version.
+	Version int64
+	// Chunks are the chunks the file is made of, and Sent the indexes of the
+	// ones that are streamed along. The owner has the others already.
+	Chunks []ChunkRef
+	Sent   []int
+}
+
+// MessageStoreFileAck is sent by an owner once it stored the file, with the
+// number of bytes it wrote and their SHA-256 checksum.
+type MessageStoreFileAck struct {
+	Size     int64
+	Checksum []byte
+	Error    string
 }
 
 type MessageGetFile struct {
@@ -81,107 +331,483 @@ type MessageGetFile struct {
 	Key string
 }
 
+// MessageGetFileResponse holds the chunks the file is made of. The chunks
+// themselves are asked for with a MessageGetChunks.
+type MessageGetFileResponse struct {
+	Found  bool
+	Size   int64
+	Chunks []ChunkRef
+}
+
 func (s *FileServer) Get(key string) (io.Reader, error) {
 	if s.store.Has(s.ID, key) {
 		fmt.Printf("%s serving file (%s) from local disk\n", s.Transport.Addr(), key)
 		_, r, err := s.store.Read(s.ID, key)
 		return r, err
 	}
+	if s.owns(s.ID, hashKey(key)) && s.store.Has(s.ID, hashKey(key)) {
+		fmt.Printf("%s serving file (%s) from our replica\n", s.Transport.Addr(), key)
+		return s.readReplica(key)
+	}
 
 	fmt.Printf("%s File not found (%s) locally, fetching from the network\n", s.Transport.Addr(), key)
 
+	// Ask the owners of the key first. When none of them has the file, e.g.
+	// because nodes joined since it was stored, the DHT is asked to find it.
+	r, err := s.quorumRead(key)
+	if err == nil || errors.Is(err, errFileDeleted) {
+		return r, err
+	}
+	log.Printf("[%s] owners of (%s) failed to serve it, falling back on the DHT: %s\n", s.Transport.Addr(), key, err)
+
+	_, holders := s.lookup(keyNodeID(hashKey(key)), &MessageFindValue{
+		ID:  s.ID,
+		Key: hashKey(key),
+	})
+	r, _, err = s.fetch(key, s.dialNodes(holders), nil)
+	return r, err
+}
+
+// readReplica decrypts our replica of the file.
+func (s *FileServer) readReplica(key string) (io.Reader, error) {
+	_, r, err := s.store.Read(s.ID, hashKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+
+	plain := new(bytes.Buffer)
+	if _, err := copyDecrypt(s.EncKey, r, plain); err != nil {
+		return nil, err
+	}
+	return plain, nil
+}
+
+// fileCopy is a copy of a file, with the peers that have it.
+type fileCopy struct {
+	MessageGetFileResponse
+	peers []p2p.Peer
+}
+
+// fetch asks the peers for the file, and stores a copy of it to disk. The
+// chunks of the file are fetched from every peer that has the same copy at
+// once. With a checksum, only a copy of which the encrypted content has that
+// checksum is accepted. The encrypted chunks are returned as well, so they
+// can be written to other nodes as they are.
+func (s *FileServer) fetch(key string, peers []p2p.Peer, checksum []byte) (io.Reader, replicaChunks, error) {
+	req := s.newRequest(len(peers))
+	defer s.closeRequest(req)
+
 	msg := Message{
+		RequestID: req.id,
 		Payload: MessageGetFile{
 			ID:  s.ID,
 			Key: hashKey(key),
 		},
 	}
 
-	if err := s.broadcast(&msg); err != nil {
-		return nil, err
-	}
+	sent := s.requestPeers(req, peers, &msg)
 
-	time.Sleep(time.Millisecond * 500)
+	// copies holds the copies of the file the peers have, in the order they
+	// answered.
+	var copies []*fileCopy
+	for i := 0; i < sent; i++ {
+		resp, err := req.wait()
+		if err != nil {
+			break
+		}
+		if resp.err != nil {
+			continue
+		}
 
-	for _, peer := range s.peers {
-		// First read the file size so we can limit the amount of bytes that we read
-		// from the connection, so it will not keep hanging.
-		var fileSize int64
-		binary.Read(peer, binary.LittleEndian, &fileSize)
+		v, ok := resp.msg.Payload.(MessageGetFileResponse)
+		peer, connected := s.peer(resp.from)
+		if !ok || !v.Found || !connected {
+			resp.discard()
+			continue
+		}
+
+		var c *fileCopy
+		for _, other := range copies {
+			if other.Size == v.Size && slices.Equal(other.Chunks, v.Chunks) {
+				c = other
+				break
+			}
+		}
+		if c == nil {
+			c = &fileCopy{MessageGetFileResponse: v}
+			copies = append(copies, c)
+		}
+		c.peers = append(c.peers, peer)
+	}
 
-		// Store the file to disk and then return the reader.
-		n, err := s.store.WriteDecrypt(s.EncKey, s.ID, key, io.LimitReader(peer, fileSize))
+	for _, c := range copies {
+		// The encrypted content is decrypted straight from the chunks in
+		// the store, and checked while it is.
+		var (
+			chunks = replicaChunks{Manifest: Manifest{Size: c.Size, Chunks: c.Chunks}, store: s.store}
+			hash   = sha256.New()
+			n      int64
+		)
+		d, err := s.downloadChunks(c.peers, c.Chunks)
+		if err == nil {
+			n, err = s.store.WriteDecrypt(s.EncKey, s.ID, key, io.TeeReader(chunks.content(), hash))
+		}
+		if err == nil && n != c.Size {
+			err = fmt.Errorf("received %d of %d bytes", n, c.Size)
+		}
+		if err == nil && checksum != nil && !bytes.Equal(hash.Sum(nil), checksum) {
+			err = fmt.Errorf("checksum mismatch")
+		}
 		if err != nil {
-			return nil, err
+			// The peers might have dropped the connection halfway, so we
+			// throw away what we've got and try the next copy.
+			log.Printf("[%s] failed to fetch file (%s) from %d nodes: %s\n", s.Transport.Addr(), key, len(c.peers), err)
+			s.store.Delete(s.ID, key)
+			continue
+		}
+
+		for from, received := range d.received {
+			fmt.Printf("[%s] received (%d) bytes over the network from (%s)\n", s.Transport.Addr(), received, from)
 		}
-		fmt.Printf("[%s] received (%d) bytes over the network from (%s)\n", s.Transport.Addr(), n, peer.RemoteAddr())
+		fmt.Printf("[%s] fetched file (%s) of (%d) bytes\n", s.Transport.Addr(), key, n)
 
-		peer.CloseStream()
+		_, r, err := s.store.Read(s.ID, key)
+		return r, chunks, err
 	}
 
-	_, r, err := s.store.Read(s.ID, key)
-	return r, err
+	return nil, replicaChunks{}, fmt.Errorf("[%s] file (%s) not found on the network", s.Transport.Addr(), key)
 }
 
 func (s *FileServer) Store(key string, r io.Reader) error {
+	// 1. Encrypt the file once, so every owner receives exactly the same
+	// bytes. Only the owners keep the file, which includes us when we own
+	// the key.
+	encBuffer := new(bytes.Buffer)
+	if _, err := copyEncrypt(s.EncKey, r, encBuffer); err != nil {
+		return err
+	}
+	// A copy that was fetched before is outdated now.
+	if err := s.store.Delete(s.ID, key); err != nil {
+		return err
+	}
+
+	size := int64(encBuffer.Len())
+	checksum := sha256.Sum256(encBuffer.Bytes())
+	content := chunkBytes(encBuffer.Bytes())
+	version := time.Now().UnixNano()
+
+	// 2. Stream this file to the owners of the key. When we own the key
+	// ourselves, we keep a replica just like the other owners do.
 	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer)
+		owners = s.Owners(key)
+		quorum = min(s.WriteQuorum, len(owners))
+		acked  = 0
+		failed = make(map[string]error)
+		remote []PeerInfo
 	)
+	for _, owner := range owners {
+		if owner.ID != s.ID {
+			remote = append(remote, owner)
+			continue
+		}
 
-	// 1. Store this file to disk
-	size, err := s.store.Write(s.ID, key, tee)
-	if err != nil {
+		meta := FileMeta{Version: version, Checksum: checksum[:]}
+		if err := s.writeReplica(s.ID, hashKey(key), meta, encBuffer.Bytes()); err != nil {
+			log.Printf("[%s] failed to write our replica of file (%s): %s\n", s.Transport.Addr(), key, err)
+			failed[owner.ListenAddr] = err
+			continue
+		}
+		acked++
+	}
+
+	// The owners that are dead are not even tried.
+	remote, dead := s.liveOwners(remote)
+	for _, owner := range dead {
+		failed[owner.ListenAddr] = errMemberDead
+	}
+
+	peers, errs := s.dialEach(remote)
+	req := s.newRequest(len(peers))
+	defer s.closeRequest(req)
+
+	store := MessageStoreFile{
+		ID:      s.ID,
+		Key:     hashKey(key),
+		Size:    size,
+		Version: version,
+		Chunks:  content.Chunks,
+	}
+
+	// replicas holds the owners we are waiting on, by the address of their peer.
+	replicas := make(map[string]PeerInfo)
+	for i, peer := range peers {
+		if errs[i] != nil {
+			failed[remote[i].ListenAddr] = errs[i]
+			continue
+		}
+
+		// Only the chunks the owner doesn't have yet are sent, e.g. the
+		// ones that changed since the previous version.
+		want, err := s.wantedChunks(peer, content)
+		if err != nil {
+			log.Printf("[%s] failed to negotiate the chunks of file (%s) with %s: %s\n", s.Transport.Addr(), key, remote[i].ListenAddr, err)
+			failed[remote[i].ListenAddr] = err
+			continue
+		}
+
+		addr := peer.RemoteAddr().String()
+		s.expect(req, addr)
+
+		payload := store
+		payload.Sent = want
+		msg := Message{
+			RequestID: req.id,
+			Payload:   payload,
+		}
+		n, err := s.sendStream(peer, &msg, content.reader(want))
+		if err != nil {
+			// Skip the owner and keep going with the others.
+			log.Printf("[%s] failed to stream file (%s) to %s: %s\n", s.Transport.Addr(), key, addr, err)
+			s.unexpect(req, addr)
+			failed[remote[i].ListenAddr] = err
+			continue
+		}
+		replicas[addr] = remote[i]
+
+		fmt.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), n, addr)
+	}
+
+	// 3. Wait until enough owners acknowledged that they stored the file
+	acked = s.awaitAcks(req, replicas, acked, quorum, failed, func(resp response) error {
+		return checkStoreAck(resp, size, checksum[:])
+	})
+
+	// 4. Keep the replicas of the owners that failed, until they are back
+	for _, owner := range append(remote, dead...) {
+		if _, ok := failed[owner.ListenAddr]; ok {
+			s.hintReplica(owner, store, checksum[:], encBuffer.Bytes())
+		}
+	}
+
+	if acked < quorum {
+		return &WriteQuorumError{
+			Key:    key,
+			Acked:  acked,
+			Quorum: quorum,
+			Failed: failed,
+		}
+	}
+
+	return nil
+}
+
+// writeReplica stores the encrypted replica of the file with its meta, unless
+// a newer version of it is stored already.
+func (s *FileServer) writeReplica(id string, key string, meta FileMeta, encrypted []byte) error {
+	if stored, _ := s.store.ReadMeta(id, key); stored.Version > meta.Version {
+		return fmt.Errorf("version %d is older than the stored version %d", meta.Version, stored.Version)
+	}
+	if _, err := s.store.Write(id, key, bytes.NewReader(encrypted)); err != nil {
 		return err
 	}
+	return s.store.WriteMeta(id, key, meta)
+}
+
+// awaitAcks waits on the acknowledgements of the owners in replicas, which are
+// keyed by the address of their peer, until quorum of them acknowledged the
+// write. The ones that did already are passed in as acked. Every owner that
+// fails the check is recorded in failed, and the number of owners that
+// acknowledged the write is returned.
+func (s *FileServer) awaitAcks(req *pendingRequest, replicas map[string]PeerInfo, acked, quorum int, failed map[string]error, check func(response) error) int {
+	for acked < quorum && len(replicas) > 0 {
+		resp, err := req.wait()
+		if err != nil {
+			for _, owner := range replicas {
+				failed[owner.ListenAddr] = err
+			}
+			break
+		}
+
+		owner, ok := replicas[resp.from]
+		if !ok {
+			resp.discard()
+			continue
+		}
+		delete(replicas, resp.from)
+
+		if err := check(resp); err != nil {
+			log.Printf("[%s] owner %s failed to write file: %s\n", s.Transport.Addr(), owner.ListenAddr, err)
+			failed[owner.ListenAddr] = err
+			continue
+		}
+		acked++
+	}
+	return acked
+}
+
+// checkStoreAck verifies that the owner stored exactly the bytes we sent.
+func checkStoreAck(resp response, size int64, checksum []byte) error {
+	if resp.err != nil {
+		return resp.err
+	}
+
+	ack, ok := resp.msg.Payload.(MessageStoreFileAck)
+	if !ok {
+		return fmt.Errorf("unexpected response: %T", resp.msg.Payload)
+	}
+	if len(ack.Error) > 0 {
+		return errors.New(ack.Error)
+	}
+	if ack.Size != size {
+		return fmt.Errorf("stored %d of %d bytes", ack.Size, size)
+	}
+	if !bytes.Equal(ack.Checksum, checksum) {
+		return fmt.Errorf("checksum mismatch")
+	}
+	return nil
+}
+
+// errReplicaRefused is returned by pushReplica when the owner answered, but
+// didn't store the replica.
+var errReplicaRefused = errors.New("replica refused")
+
+// pushReplica sends the encrypted replica of the file, with the version and
+// checksum in meta, to the owner on the other end of the peer. Only the
+// chunks the owner is missing are sent, within the limiter when there is one.
+// It returns the number of bytes that were sent.
+func (s *FileServer) pushReplica(peer p2p.Peer, id string, key string, meta FileMeta, chunks replicaChunks, limiter *rateLimiter) (int64, error) {
+	want, err := s.wantedChunks(peer, chunks)
+	if err != nil {
+		return 0, err
+	}
+
+	req := s.newRequest(1)
+	defer s.closeRequest(req)
+
+	addr := peer.RemoteAddr().String()
+	s.expect(req, addr)
 
-	// 2. Broadcast this file to all the peers
 	msg := Message{
+		RequestID: req.id,
 		Payload: MessageStoreFile{
-			ID:   s.ID,
-			Key:  hashKey(key),
-			Size: size + 16,
+			ID:      id,
+			Key:     key,
+			Size:    chunks.Size,
+			Version: meta.Version,
+			Chunks:  chunks.Chunks,
+			Sent:    want,
 		},
 	}
+	body := chunks.reader(want)
+	if limiter != nil {
+		body = limiter.reader(body)
+	}
+	n, err := s.sendStream(peer, &msg, body)
+	if err != nil {
+		return n, err
+	}
 
-	if err := s.broadcast(&msg); err != nil {
-		return err
+	resp, err := req.wait()
+	if err != nil {
+		return n, err
+	}
+	if resp.err != nil {
+		return n, resp.err
+	}
+	if err := checkStoreAck(resp, chunks.Size, meta.Checksum); err != nil {
+		return n, fmt.Errorf("%w: %s", errReplicaRefused, err)
 	}
+	return n, nil
+}
 
-	time.Sleep(time.Millisecond * 5)
+// WriteQuorumError is returned by Store and Delete when less owners than the
+// write quorum acknowledged the write.
+type WriteQuorumError struct {
+	Key    string
+	Acked  int
+	Quorum int
+	// Failed holds why the write failed, by the listen address of the owner.
+	Failed map[string]error
+}
 
-	var peers []io.Writer
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+func (e *WriteQuorumError) Error() string {
+	addrs := make([]string, 0, len(e.Failed))
+	for addr := range e.Failed {
+		addrs = append(addrs, addr)
 	}
-	mw := io.MultiWriter(peers...)
+	sort.Strings(addrs)
 
-	mw.Write([]byte{p2p.IncomingStream})
-	n, err := copyEncrypt(s.EncKey, fileBuffer, mw)
-	if err != nil {
-		return err
+	failed := make([]string, len(addrs))
+	for i, addr := range addrs {
+		failed[i] = fmt.Sprintf("%s: %s", addr, e.Failed[addr])
 	}
 
-	fmt.Printf("[%s] received and written (%d) bytes to disk\n", s.Transport.Addr(), n)
-
-	return nil
+	return fmt.Sprintf("write of file (%s) acknowledged by %d of %d owners, failed on [%s]", e.Key, e.Acked, e.Quorum, strings.Join(failed, ", "))
 }
 
 func (s *FileServer) Stop() {
 	close(s.quitch)
 }
 
+// Peers returns the connection state of every node the server knows about.
+func (s *FileServer) Peers() []PeerStatus {
+	return s.peerManager.status()
+}
+
 func (s *FileServer) OnPeer(p p2p.Peer) error {
-	s.peerLock.Lock()
-	defer s.peerLock.Unlock()
+	addr := p.RemoteAddr().String()
 
-	s.peers[p.RemoteAddr().String()] = p
+	// We dialed the same address twice, e.g. when a bootstrap node is
+	// also handed to us through peer exchange.
+	s.peerLock.Lock()
+	if _, ok := s.peers[addr]; ok {
+		s.peerLock.Unlock()
+		return fmt.Errorf("already connected with %s", addr)
+	}
+	s.peers[addr] = p
+	s.peerLock.Unlock()
 
 	log.Println("New peer connected: ", p.RemoteAddr())
 
+	hello := Message{
+		Payload: MessageHello{
+			ID:         s.ID,
+			ListenAddr: s.Transport.Addr(),
+		},
+	}
+	if err := s.send(p, &hello); err != nil {
+		// The transport drops the connection without telling OnPeerDisconnect,
+		// so the peer has to be removed here.
+		s.peerLock.Lock()
+		delete(s.peers, addr)
+		s.peerLock.Unlock()
+		return err
+	}
 	return nil
 }
 
+// OnPeerDisconnect removes the peer, and fails the requests that are still
+// waiting on a response from it.
+func (s *FileServer) OnPeerDisconnect(p p2p.Peer, reason error) {
+	addr := p.RemoteAddr().String()
+
+	s.peerLock.Lock()
+	// Only remove the peer if it wasn't replaced by a new connection already.
+	if s.peers[addr] == p {
+		delete(s.peers, addr)
+		delete(s.nodes, addr)
+	}
+	s.peerLock.Unlock()
+
+	s.failPending(addr, errPeerDisconnected)
+	s.peerManager.disconnected(addr)
+
+	log.Printf("Peer disconnected: %s (%v)\n", addr, reason)
+}
+
 func (s *FileServer) loop() {
 	defer func() {
 		log.Println("File server stopped due to error or user quit action.")
@@ -194,101 +820,247 @@ func (s *FileServer) loop() {
 			var msg Message
 			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
 				log.Println("decoding error: ", err)
+				if rpc.Body != nil {
+					rpc.Body.Close()
+				}
+				rpc.Accept()
+				continue
 			}
 
-			if err := s.handleMessage(rpc.From, &msg); err != nil {
-				log.Println("handle message error: ", err)
-			}
+			s.dispatch(rpc.From, rpc.Body, &msg, rpc.Accept)
 		case <-s.quitch:
 			return
 		}
 	}
 }
 
-func (s *FileServer) handleMessage(from string, msg *Message) error {
+// handleMessage handles a message from the peer. The body is only set when the
+// message is the header of a stream, and is closed once it has been read.
+func (s *FileServer) handleMessage(from string, body io.ReadCloser, msg *Message) error {
 	switch v := msg.Payload.(type) {
+	case MessageHello:
+		return s.handleMessageHello(from, v)
+	case MessagePeerExchange:
+		return s.handleMessagePeerExchange(from)
+	case MessagePeers:
+		return s.handleMessagePeers(from, v)
 	case MessageStoreFile:
-		return s.handleMessageStoreFile(from, v)
+		return s.handleMessageStoreFile(from, msg.RequestID, v, body)
 	case MessageGetFile:
-		return s.handleMessageGetFile(from, v)
+		return s.handleMessageGetFile(from, msg.RequestID, v)
+	case MessageStatFile:
+		return s.handleMessageStatFile(from, msg.RequestID, v)
+	case MessageDeleteFile:
+		return s.handleMessageDeleteFile(from, msg.RequestID, v)
+	case MessageFindNode:
+		return s.handleMessageFindNode(from, msg.RequestID, v)
+	case MessageFindValue:
+		return s.handleMessageFindValue(from, msg.RequestID, v)
+	case MessageSyncTree:
+		return s.handleMessageSyncTree(from, msg.RequestID, v)
+	case MessageSyncEntries:
+		return s.handleMessageSyncEntries(from, msg.RequestID, v)
+	case MessagePing:
+		return s.handleMessagePing(from, msg.RequestID, v)
+	case MessagePingReq:
+		return s.handleMessagePingReq(from, msg.RequestID, v)
+	case MessageHaveChunks:
+		return s.handleMessageHaveChunks(from, msg.RequestID, v)
+	case MessageGetChunks:
+		return s.handleMessageGetChunks(from, msg.RequestID, v)
 	}
 
+	if isResponse(msg.Payload) {
+		return s.handleResponse(from, body, msg)
+	}
 	return nil
 }
 
-func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
-	if !s.store.Has(msg.ID, msg.Key) {
-		return fmt.Errorf("[%s] file (%s) does not exist on disk\n", s.Transport.Addr(), msg.Key)
+// isResponse reports whether the payload answers one of our requests.
+func isResponse(payload any) bool {
+	switch payload.(type) {
+	case MessageStoreFileAck, MessageDeleteFileAck, MessageGetFileResponse, MessageStatFileResponse, MessageFindNodeResponse, MessageFindValueResponse,
+		MessageSyncTreeResponse, MessageSyncEntriesResponse, MessagePingAck, MessageWantChunks, MessageGetChunksResponse:
+		return true
 	}
+	return false
+}
 
-	fmt.Printf("[%s] serving file (%s) over the network\n", s.Transport.Addr(), msg.Key)
+func (s *FileServer) handleMessageHello(from string, msg MessageHello) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer not found: %s", from)
+	}
 
-	fileSize, r, err := s.store.Read(msg.ID, msg.Key)
-	if err != nil {
-		return err
+	// We dialed ourselves, e.g. through an address a peer told us about.
+	if msg.ID == s.ID {
+		return peer.Close()
 	}
 
-	rc, ok := r.(io.ReadCloser)
-	if ok {
-		fmt.Println("Closing the file reader")
-		defer rc.Close()
+	s.peerLock.Lock()
+	duplicate := ""
+	for addr, node := range s.nodes {
+		if node.ID == msg.ID && addr != from {
+			duplicate = addr
+		}
+	}
+
+	// When both nodes dialed each other at the same time, there are two connections
+	// between them. Both nodes keep the connection that was dialed by the node
+	// with the lowest ID, so they end up with the same one.
+	if len(duplicate) > 0 {
+		other := s.peers[duplicate]
+		if s.dialer(peer, msg.ID) == s.dialer(other, msg.ID) || s.dialer(other, msg.ID) == minID(s.ID, msg.ID) {
+			s.peerLock.Unlock()
+			log.Printf("[%s] dropping duplicate connection with %s\n", s.Transport.Addr(), from)
+			return peer.Close()
+		}
+
+		delete(s.nodes, duplicate)
+		defer func() {
+			log.Printf("[%s] dropping duplicate connection with %s\n", s.Transport.Addr(), duplicate)
+			other.Close()
+		}()
+	}
+
+	s.nodes[from] = remoteNode{ID: msg.ID, ListenAddr: msg.ListenAddr}
+	delete(s.departures, msg.ID)
+	s.peerLock.Unlock()
+
+	s.peerManager.connected(msg.ListenAddr, from)
+
+	// A node that is not a member yet joined the cluster, and takes over
+	// some of the keys.
+	node := PeerInfo{ID: msg.ID, ListenAddr: msg.ListenAddr}
+	s.seen(node)
+	s.membersChanged(s.memberList.join(node))
+	s.helloReceived(msg.ID)
+
+	// The node is back, the ping tells it that we declared it dead so it
+	// refutes that.
+	if s.memberState(msg.ID) == MemberDead {
+		go s.ping(node)
 	}
 
-	peer, ok := s.peers[from]
+	go s.deliverHints(node, peer)
+
+	// Ask the new peer right away which nodes it knows about, so a cluster
+	// forms quickly from a single seed.
+	exchange := Message{Payload: MessagePeerExchange{}}
+	return s.send(peer, &exchange)
+}
+
+// dialer returns the ID of the node that dialed the connection with the peer.
+func (s *FileServer) dialer(peer p2p.Peer, remoteID string) string {
+	if peer.Outbound() {
+		return s.ID
+	}
+	return remoteID
+}
+
+func minID(a, b string) string {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (s *FileServer) handleMessageGetFile(from string, requestID uint64, msg MessageGetFile) error {
+	peer, ok := s.peer(from)
 	if !ok {
 		return fmt.Errorf("peer not found: %s", from)
 	}
 
-	// First send the "incomingStream" byte to the peer, and then we can send
-	// the file size as an int64.
-	peer.Send([]byte{p2p.IncomingStream})
-	//var fileSize int64 = 22
-	binary.Write(peer, binary.LittleEndian, fileSize)
+	if !s.store.Has(msg.ID, msg.Key) {
+		resp := Message{
+			RequestID: requestID,
+			Payload:   MessageGetFileResponse{Found: false},
+		}
+		return s.send(peer, &resp)
+	}
 
-	n, err := io.Copy(peer, r)
+	manifest, err := s.store.ReadManifest(msg.ID, msg.Key)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("[%s] written %d bytes over the network to %s\n", s.Transport.Addr(), n, from)
+	fmt.Printf("[%s] serving file (%s) over the network\n", s.Transport.Addr(), msg.Key)
 
-	return nil
+	resp := Message{
+		RequestID: requestID,
+		Payload: MessageGetFileResponse{
+			Found:  true,
+			Size:   manifest.Size,
+			Chunks: manifest.Chunks,
+		},
+	}
+	return s.send(peer, &resp)
 }
 
-func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
+func (s *FileServer) handleMessageStoreFile(from string, requestID uint64, msg MessageStoreFile, stream io.ReadCloser) error {
 	fmt.Printf("Received file store message: %+v\n", msg.Key)
-	peer, ok := s.peers[from]
+	peer, ok := s.peer(from)
 	if !ok {
+		if stream != nil {
+			stream.Close()
+		}
 		return fmt.Errorf("peer not found: %s", from)
 	}
+	if stream == nil {
+		return fmt.Errorf("file store message from %s without a stream", from)
+	}
 
-	defer peer.CloseStream()
+	var (
+		n   int64
+		sum []byte
+		err error
+	)
+	// A tombstone keeps a lagging owner from bringing a deleted file back.
+	if meta, _ := s.store.ReadMeta(msg.ID, msg.Key); meta.Version > msg.Version {
+		err = fmt.Errorf("version %d is older than the stored version %d", msg.Version, meta.Version)
+	} else if err = checkSentChunks(msg.Chunks, msg.Sent); err == nil {
+		body := io.LimitReader(stream, replicaChunks{Manifest: Manifest{Chunks: msg.Chunks}}.size(msg.Sent))
+		n, sum, err = s.store.WriteChunks(msg.ID, msg.Key, msg.Chunks, msg.Sent, body)
+		if err == nil && n != msg.Size {
+			err = fmt.Errorf("received %d of %d bytes", n, msg.Size)
+			s.store.Delete(msg.ID, msg.Key)
+		}
+		if err == nil {
+			err = s.store.WriteMeta(msg.ID, msg.Key, FileMeta{Version: msg.Version, Checksum: sum})
+		}
+	}
+
+	stream.Close()
 
-	n, err := s.store.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
+	ack := MessageStoreFileAck{
+		Size:     n,
+		Checksum: sum,
+	}
 	if err != nil {
-		return err
+		ack.Error = err.Error()
+	} else {
+		log.Printf("%s written %d bytes to disk", s.Transport.Addr(), n)
 	}
 
-	log.Printf("%s written %d bytes to disk", s.Transport.Addr(), n)
-	return nil
+	resp := Message{
+		RequestID: requestID,
+		Payload:   ack,
+	}
+	return s.send(peer, &resp)
 }
 
 func (s *FileServer) bootstrapNetwork() error {
 	for _, addr := range s.BootstrapNodes {
-		if len(addr) == 0 {
-			continue
-		}
-
-		go func(addr string) {
-			fmt.Printf("[%s] attempt to connect with remote %s\n", s.Transport.Addr(), addr)
-
-			if err := s.Transport.Dial(addr); err != nil {
-				log.Println("Failed to dial to bootstrap node: ", addr)
-				log.Println("Error: ", err)
-			}
-		}(addr)
+		s.peerManager.add(addr)
 	}
 
+	go s.peerManager.loop()
+	go s.peerExchangeLoop()
+	go s.antiEntropyLoop()
+	go s.departureLoop()
+	go s.probeLoop()
+	go s.garbageLoop()
+
 	return nil
 }
 
@@ -309,6 +1081,30 @@ func (s *FileServer) Start() error {
 }
 
 func init() {
+	gob.Register(MessageHello{})
+	gob.Register(MessagePeerExchange{})
+	gob.Register(MessagePeers{})
+	gob.Register(MessageFindNode{})
+	gob.Register(MessageFindNodeResponse{})
+	gob.Register(MessageFindValue{})
+	gob.Register(MessageFindValueResponse{})
 	gob.Register(MessageStoreFile{})
+	gob.Register(MessageStoreFileAck{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageGetFileResponse{})
+	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageDeleteFileAck{})
+	gob.Register(MessageStatFile{})
+	gob.Register(MessageStatFileResponse{})
+	gob.Register(MessageSyncTree{})
+	gob.Register(MessageSyncTreeResponse{})
+	gob.Register(MessageSyncEntries{})
+	gob.Register(MessageSyncEntriesResponse{})
+	gob.Register(MessagePing{})
+	gob.Register(MessagePingReq{})
+	gob.Register(MessagePingAck{})
+	gob.Register(MessageHaveChunks{})
+	gob.Register(MessageWantChunks{})
+	gob.Register(MessageGetChunks{})
+	gob.Register(MessageGetChunksResponse{})
 }
@@ -0,0 +1,1170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/ZainAli104/distributed-file-system-go/p2p"
+	"io"
+	"math/rand"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func makeMemServer(t *testing.T, network *p2p.MemNetwork, listenAddr string, injector *p2p.FaultInjector) *FileServer {
+	memTransport := p2p.NewMemTransport(p2p.MemTransportOpts{
+		TCPTransportOpts: p2p.TCPTransportOpts{
+			ListenAddr:        listenAddr,
+			HandshakeFunc:     p2p.NOPHandshakeFunc,
+			Decoder:           p2p.DefaultDecoder{},
+			HeartbeatInterval: 100 * time.Millisecond,
+			IdleTimeout:       2 * time.Second,
+			IOTimeout:         2 * time.Second,
+			AwaitAccept:       true,
+		},
+		Network: network,
+	})
+
+	var transport p2p.Transport = memTransport
+	if injector != nil {
+		memTransport.WrapConn = injector.WrapConn
+		transport = p2p.NewFaultyTransport(memTransport, injector)
+	}
+
+	s := NewFileServer(FileServerOpts{
+		EncKey:            newEncryptionKey(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Transport:         transport,
+		RequestTimeout:    2 * time.Second,
+		// Keep the reconnects fast, so the tests don't have to wait long.
+		MinReconnectBackoff:  10 * time.Millisecond,
+		MaxReconnectBackoff:  100 * time.Millisecond,
+		PeerExchangeInterval: 100 * time.Millisecond,
+		ProbeInterval:        50 * time.Millisecond,
+		ProbeTimeout:         200 * time.Millisecond,
+		SuspicionTimeout:     time.Second,
+	})
+
+	memTransport.OnPeer = s.OnPeer
+	memTransport.OnPeerDisconnect = s.OnPeerDisconnect
+
+	return s
+}
+
+// startMemServer starts the next file server of the cluster, which bootstraps
+// with the servers that were started before it.
+func startMemServer(t *testing.T, network *p2p.MemNetwork, servers []*FileServer, injector *p2p.FaultInjector) *FileServer {
+	s := makeMemServer(t, network, fmt.Sprintf("node_%d", len(servers)), injector)
+	for _, remote := range servers {
+		s.BootstrapNodes = append(s.BootstrapNodes, remote.Transport.Addr())
+	}
+	go s.Start()
+	t.Cleanup(s.Stop)
+
+	return s
+}
+
+// makeMemCluster starts n file servers of which every server is connected
+// to all the others.
+func makeMemCluster(t *testing.T, n int) []*FileServer {
+	return makeFaultyMemCluster(t, n, nil)
+}
+
+// makeFaultyMemCluster is makeMemCluster in which the servers that have an
+// entry in injectors go through that fault injector.
+func makeFaultyMemCluster(t *testing.T, n int, injectors map[int]*p2p.FaultInjector) []*FileServer {
+	network := p2p.NewMemNetwork()
+
+	servers := make([]*FileServer, 0, n)
+	for i := 0; i < n; i++ {
+		servers = append(servers, startMemServer(t, network, servers, injectors[i]))
+	}
+
+	// A node is only usable once it said hello.
+	for _, s := range servers {
+		waitFor(t, func() bool { return len(s.knownNodes()) == n-1 })
+	}
+
+	return servers
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// dropLocalCopy removes the file, and the chunks it was made of, from the disk
+// of the server, so it has to be fetched from the network.
+func dropLocalCopy(t *testing.T, s *FileServer, key string) {
+	for _, k := range []string{key, hashKey(key)} {
+		if err := s.store.Delete(s.ID, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.store.CollectGarbage(0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readAll(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		rc.Close()
+	}
+	return b
+}
+
+func TestFileServerStoreGet(t *testing.T) {
+	servers := makeMemCluster(t, 5)
+
+	for i, s := range servers {
+		key := fmt.Sprintf("picture_%d.jpg", i)
+		data := bytes.Repeat([]byte(key), 1000)
+
+		if err := s.Store(key, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+
+		// Remove the local copy, so it has to come from the network.
+		dropLocalCopy(t, s, key)
+
+		r, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b := readAll(t, r); !bytes.Equal(b, data) {
+			t.Errorf("expected %d bytes of %s, got %d bytes", len(data), key, len(b))
+		}
+	}
+}
+
+func TestFileServerConcurrentGet(t *testing.T) {
+	servers := makeMemCluster(t, 3)
+	s := servers[0]
+
+	files := make(map[string][]byte)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("file_%d", i)
+		files[key] = bytes.Repeat([]byte{byte(i)}, 10*1024+i)
+
+		if err := s.Store(key, bytes.NewReader(files[key])); err != nil {
+			t.Fatal(err)
+		}
+		dropLocalCopy(t, s, key)
+	}
+
+	var wg sync.WaitGroup
+	for key, data := range files {
+		wg.Add(1)
+		go func(key string, data []byte) {
+			defer wg.Done()
+
+			r, err := s.Get(key)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if b := readAll(t, r); !bytes.Equal(b, data) {
+				t.Errorf("expected %d bytes of %s, got %d bytes", len(data), key, len(b))
+			}
+		}(key, data)
+	}
+	wg.Wait()
+}
+
+func TestFileServerStreamsBothWays(t *testing.T) {
+	servers := makeMemCluster(t, 2)
+	a, b := servers[0], servers[1]
+
+	// The files are larger than the window of a stream, so they can only be
+	// sent while the other side reads them.
+	files := make(map[string][]byte)
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("file_%d", i)
+		files[key] = bytes.Repeat([]byte{byte(i)}, p2p.StreamWindow+i)
+
+		if err := a.Store(key, bytes.NewReader(files[key])); err != nil {
+			t.Fatal(err)
+		}
+		dropLocalCopy(t, a, key)
+	}
+
+	// a fetches its files from b, while b stores a file on a over the same
+	// connection.
+	var wg sync.WaitGroup
+	for key, data := range files {
+		wg.Add(1)
+		go func(key string, data []byte) {
+			defer wg.Done()
+
+			r, err := a.Get(key)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if b := readAll(t, r); !bytes.Equal(b, data) {
+				t.Errorf("expected %d bytes of %s, got %d bytes", len(data), key, len(b))
+			}
+		}(key, data)
+	}
+
+	data := bytes.Repeat([]byte("b"), 2*p2p.StreamWindow)
+	if err := b.Store("upload", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if !a.store.Has(b.ID, hashKey("upload")) {
+		t.Error("expected the upload to be stored on a")
+	}
+}
+
+func TestFileServerGetPeerDropsMidStream(t *testing.T) {
+	// node_1 drops every connection once it has written 4KB to it, which
+	// happens halfway through serving the file.
+	injector := p2p.NewFaultInjector(p2p.FaultOpts{
+		Seed:           1,
+		Latency:        time.Millisecond,
+		LatencyJitter:  time.Millisecond,
+		DropAfterBytes: 4 * 1024,
+	})
+	servers := makeFaultyMemCluster(t, 2, map[int]*p2p.FaultInjector{
+		1: injector,
+	})
+	s := servers[0]
+
+	key := "big_picture.jpg"
+	if err := s.Store(key, bytes.NewReader(make([]byte, 16*1024))); err != nil {
+		t.Fatal(err)
+	}
+	dropLocalCopy(t, s, key)
+
+	errch := make(chan error, 1)
+	go func() {
+		_, err := s.Get(key)
+		errch <- err
+	}()
+
+	select {
+	case err := <-errch:
+		if err == nil {
+			t.Fatal("expected Get to fail when the peer drops the connection")
+		}
+	case <-time.After(2 * s.RequestTimeout):
+		t.Fatal("Get hangs when the peer drops the connection mid-stream")
+	}
+
+	if s.store.Has(s.ID, key) {
+		t.Error("expected the partially received file to be removed")
+	}
+}
+
+func TestFileServerPartition(t *testing.T) {
+	injector := p2p.NewFaultInjector(p2p.FaultOpts{Seed: 1})
+	servers := makeFaultyMemCluster(t, 3, map[int]*p2p.FaultInjector{
+		0: injector,
+		1: injector,
+		2: injector,
+	})
+
+	s := servers[0]
+	if err := s.Store("foo", bytes.NewReader([]byte("bar"))); err != nil {
+		t.Fatal(err)
+	}
+	dropLocalCopy(t, s, "foo")
+
+	injector.Partition([]string{"node_0"}, []string{"node_1", "node_2"})
+
+	if _, err := s.Get("foo"); err == nil {
+		t.Fatal("expected Get to fail on a partitioned node")
+	}
+
+	if err := servers[1].Transport.Dial("node_0"); err == nil {
+		t.Fatal("expected dialing across the partition to fail")
+	}
+}
+
+func TestFileServerPeerDisconnect(t *testing.T) {
+	injector := p2p.NewFaultInjector(p2p.FaultOpts{Seed: 1})
+	servers := makeFaultyMemCluster(t, 3, map[int]*p2p.FaultInjector{
+		2: injector,
+	})
+	s := servers[0]
+
+	// Cut node_2 off from the others, its peers have to be removed.
+	injector.Partition([]string{"node_2"}, []string{"node_0", "node_1"})
+	waitFor(t, func() bool { return len(s.peerList()) == 1 })
+	waitFor(t, func() bool { return len(servers[1].peerList()) == 1 })
+
+	// Store and Get keep working with the peers that are left.
+	data := []byte("my big data file here!")
+	if err := s.Store("foo", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	dropLocalCopy(t, s, "foo")
+
+	r, err := s.Get("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := readAll(t, r); !bytes.Equal(b, data) {
+		t.Errorf("expected %s, got %s", data, b)
+	}
+}
+
+func TestFileServerReconnect(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	injector := p2p.NewFaultInjector(p2p.FaultOpts{Seed: 1})
+
+	// node_1 starts before its seed, and has to keep on trying until the seed is up.
+	s1 := makeMemServer(t, network, "node_1", injector)
+	s1.BootstrapNodes = []string{"node_0"}
+	go s1.Start()
+	t.Cleanup(s1.Stop)
+
+	time.Sleep(50 * time.Millisecond)
+
+	s0 := makeMemServer(t, network, "node_0", nil)
+	go s0.Start()
+	t.Cleanup(s0.Stop)
+
+	waitFor(t, func() bool { return len(s0.peerList()) == 1 && len(s1.peerList()) == 1 })
+
+	// Once the connection is lost, node_1 dials the seed again.
+	injector.Partition([]string{"node_0"}, []string{"node_1"})
+	waitFor(t, func() bool { return len(s0.peerList()) == 0 && len(s1.peerList()) == 0 })
+
+	injector.Heal()
+	waitFor(t, func() bool { return len(s0.peerList()) == 1 && len(s1.peerList()) == 1 })
+
+	status := s1.Peers()
+	if len(status) != 1 || status[0].Addr != "node_0" {
+		t.Fatalf("expected node_0 to be the only known peer, got %+v", status)
+	}
+	waitFor(t, func() bool { return s1.Peers()[0].State == peerConnected.String() })
+}
+
+func TestFileServerDuplicateConnections(t *testing.T) {
+	network := p2p.NewMemNetwork()
+
+	// Both nodes dial each other, they have to end up with a single connection.
+	s0 := makeMemServer(t, network, "node_0", nil)
+	s1 := makeMemServer(t, network, "node_1", nil)
+	s0.BootstrapNodes = []string{"node_1"}
+	s1.BootstrapNodes = []string{"node_0"}
+
+	for _, s := range []*FileServer{s0, s1} {
+		go s.Start()
+		t.Cleanup(s.Stop)
+	}
+
+	waitFor(t, func() bool {
+		s0.peerLock.Lock()
+		defer s0.peerLock.Unlock()
+		s1.peerLock.Lock()
+		defer s1.peerLock.Unlock()
+
+		return len(s0.peers) == 1 && len(s1.peers) == 1 && len(s0.nodes) == 1 && len(s1.nodes) == 1
+	})
+
+	// The connection they kept has to be the same one on both sides.
+	time.Sleep(50 * time.Millisecond)
+
+	s0.peerLock.Lock()
+	defer s0.peerLock.Unlock()
+	s1.peerLock.Lock()
+	defer s1.peerLock.Unlock()
+
+	if len(s0.peers) != 1 || len(s1.peers) != 1 {
+		t.Fatalf("expected a single connection, got %d and %d", len(s0.peers), len(s1.peers))
+	}
+	for _, p0 := range s0.peers {
+		for _, p1 := range s1.peers {
+			if p0.Outbound() == p1.Outbound() {
+				t.Error("expected both nodes to keep the same connection")
+			}
+		}
+	}
+}
+
+func TestFileServerPeerExchange(t *testing.T) {
+	network := p2p.NewMemNetwork()
+
+	// Every node only knows about the seed, and has to find the others
+	// through peer exchange.
+	servers := make([]*FileServer, 5)
+	for i := range servers {
+		s := makeMemServer(t, network, fmt.Sprintf("node_%d", i), nil)
+		if i > 0 {
+			s.BootstrapNodes = []string{"node_0"}
+		}
+		servers[i] = s
+
+		go s.Start()
+		t.Cleanup(s.Stop)
+	}
+
+	for _, s := range servers {
+		waitFor(t, func() bool { return len(s.knownNodes()) == len(servers)-1 })
+	}
+}
+
+func TestPeerManagerLearnedPeers(t *testing.T) {
+	s := makeMemServer(t, p2p.NewMemNetwork(), "node_0", nil)
+	// Only the node that dial makes due is dialed.
+	s.MinReconnectBackoff, s.MaxReconnectBackoff = time.Hour, time.Hour
+	m := s.peerManager
+
+	// dial reports whether the node is dialed, as soon as it is due. All
+	// dials fail.
+	dial := func(addr string) bool {
+		m.lock.Lock()
+		if p, ok := m.peers[addr]; ok {
+			p.nextDial = time.Time{}
+		}
+		m.lock.Unlock()
+
+		addrs := m.dialable()
+		for _, addr := range addrs {
+			m.failed(addr, errors.New("connection refused"))
+		}
+		return slices.Contains(addrs, addr)
+	}
+
+	// A node that only one peer vouches for is dialed once.
+	m.learn("node_1", "a")
+	if !dial("node_1") {
+		t.Fatal("expected the learned node to be dialed")
+	}
+	if dial("node_1") {
+		t.Fatal("expected the learned node not to be dialed again")
+	}
+
+	// A node that more peers vouch for is dialed until it failed too often.
+	m.learn("node_1", "a")
+	m.learn("node_1", "b")
+	for i := range maxLearnedAttempts {
+		if !dial("node_1") {
+			t.Fatalf("expected the vouched for node to be dialed again after %d attempts", i)
+		}
+	}
+	if dial("node_1") {
+		t.Fatal("expected the failing node to be forgotten")
+	}
+	if len(m.status()) > 0 {
+		t.Fatalf("expected no known peers, got %+v", m.status())
+	}
+
+	// A node that said hello to us once is dialed again, until it failed
+	// too often. One we were configured with is never forgotten.
+	m.learn("node_2", "a")
+	m.connected("node_2", "node_2#1")
+	m.disconnected("node_2#1")
+	m.add("node_3")
+	for range maxLearnedAttempts {
+		if !dial("node_2") || !dial("node_3") {
+			t.Fatal("expected the node to be dialed again")
+		}
+	}
+	if dial("node_2") || !dial("node_3") {
+		t.Fatal("expected only the configured node to be dialed again")
+	}
+}
+
+func TestFileServerStoreOnOwners(t *testing.T) {
+	servers := makeMemCluster(t, 6)
+	s := servers[0]
+
+	// Every node agrees on who owns the key.
+	key := "picture.jpg"
+	owners := s.Owners(key)
+	if len(owners) != s.ReplicationFactor {
+		t.Fatalf("expected %d owners, got %d", s.ReplicationFactor, len(owners))
+	}
+	for _, other := range servers[1:] {
+		if o := other.Owners(key); !reflect.DeepEqual(o, owners) {
+			t.Errorf("%s sees owners %v, expected %v", other.Transport.Addr(), o, owners)
+		}
+	}
+
+	data := []byte("my big data file here!")
+	if err := s.Store(key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the owners receive the file, of which some might still be busy
+	// with it once the write quorum is reached. The writer is no exception.
+	isOwner := make(map[string]bool)
+	for _, owner := range owners {
+		isOwner[owner.ID] = true
+	}
+	for _, other := range servers {
+		if isOwner[other.ID] {
+			waitFor(t, func() bool { return other.store.Has(s.ID, hashKey(key)) })
+		} else if other.store.Has(s.ID, hashKey(key)) {
+			t.Errorf("%s does not own the key, but has the file", other.Transport.Addr())
+		}
+	}
+	if s.store.Has(s.ID, key) {
+		t.Errorf("the writer kept a copy of the file outside of its replica")
+	}
+
+	// A writer that owns the key serves the file from its replica.
+	if isOwner[s.ID] {
+		r, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := readAll(t, r); !bytes.Equal(b, data) {
+			t.Errorf("expected %s, got %s", data, b)
+		}
+	}
+
+	dropLocalCopy(t, s, key)
+
+	r, err := s.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := readAll(t, r); !bytes.Equal(b, data) {
+		t.Errorf("expected %s, got %s", data, b)
+	}
+}
+
+func TestFileServerSendsMissingChunks(t *testing.T) {
+	servers := makeMemCluster(t, 2)
+	s, other := servers[0], servers[1]
+	waitFor(t, func() bool { return len(s.peerList()) == 1 })
+	peer := s.peerList()[0]
+
+	key := "video.mp4"
+	data := make([]byte, 512<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := s.Store(key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return other.store.Has(s.ID, hashKey(key)) })
+
+	// A new version that only differs in a few bytes only costs the chunks
+	// around them.
+	copy(data[200<<10:], "a few changed bytes")
+	encrypted := new(bytes.Buffer)
+	if _, err := copyEncrypt(s.EncKey, bytes.NewReader(data), encrypted); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(encrypted.Bytes())
+	meta := FileMeta{Version: time.Now().UnixNano(), Checksum: sum[:]}
+	chunks := chunkBytes(encrypted.Bytes())
+
+	n, err := s.pushReplica(peer, s.ID, hashKey(key), meta, chunks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 || n > int64(encrypted.Len())/4 {
+		t.Errorf("expected only the changed chunks to be sent, sent %d of %d bytes", n, encrypted.Len())
+	}
+
+	// Once the owner has every chunk, nothing is sent at all.
+	if n, err := s.pushReplica(peer, s.ID, hashKey(key), meta, chunks, nil); err != nil || n != 0 {
+		t.Errorf("expected nothing to be sent, sent %d bytes: %v", n, err)
+	}
+
+	// The new version is served from the chunks of the owner.
+	dropLocalCopy(t, s, key)
+	r, err := s.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := readAll(t, r); !bytes.Equal(b, data) {
+		t.Errorf("expected the new version of %d bytes, got %d bytes", len(data), len(b))
+	}
+}
+
+func TestFileServerMultiSourceGet(t *testing.T) {
+	// The latency keeps either owner from sending the whole file before the
+	// other one sent its first piece.
+	servers := makeFaultyMemCluster(t, 3, map[int]*p2p.FaultInjector{
+		1: p2p.NewFaultInjector(p2p.FaultOpts{Latency: time.Millisecond}),
+		2: p2p.NewFaultInjector(p2p.FaultOpts{Latency: time.Millisecond}),
+	})
+	s := servers[0]
+
+	key := "movie.mkv"
+	data := make([]byte, 2<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := s.Store(key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	for _, other := range servers[1:] {
+		waitFor(t, func() bool { return other.store.Has(s.ID, hashKey(key)) })
+	}
+
+	dropLocalCopy(t, s, key)
+	r, err := s.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := readAll(t, r); !bytes.Equal(b, data) {
+		t.Fatalf("expected %d bytes, got %d bytes", len(data), len(b))
+	}
+
+	manifest, err := servers[1].store.ReadManifest(s.ID, hashKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := servers[1].store.ReadMeta(s.ID, hashKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	download := func() *download {
+		// The chunks fetched before are no part of any file of ours.
+		if _, err := s.store.CollectGarbage(0); err != nil {
+			t.Fatal(err)
+		}
+		d, err := s.downloadChunks(s.peerList(), manifest.Chunks)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Every chunk is stored once the download is done.
+		chunks := replicaChunks{Manifest: manifest, store: s.store}
+		hash := sha256.New()
+		if _, err := io.Copy(hash, chunks.content()); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(hash.Sum(nil), meta.Checksum) {
+			t.Fatal("checksum mismatch")
+		}
+		return d
+	}
+
+	// The pieces are spread over both owners.
+	if d := download(); len(d.received) != 2 {
+		t.Errorf("expected the file from 2 nodes, got it from %d", len(d.received))
+	}
+
+	// Once one of the owners lost the file, the pieces it fails to send are
+	// fetched from the other one.
+	servers[2].store.Delete(s.ID, hashKey(key))
+	if _, err := servers[2].store.CollectGarbage(0); err != nil {
+		t.Fatal(err)
+	}
+	if d := download(); len(d.received) != 1 {
+		t.Errorf("expected the file from 1 node, got it from %d", len(d.received))
+	}
+}
+
+func TestFileServerWriteQuorum(t *testing.T) {
+	injector := p2p.NewFaultInjector(p2p.FaultOpts{Seed: 1})
+	servers := makeFaultyMemCluster(t, 3, map[int]*p2p.FaultInjector{
+		2: injector,
+	})
+	s := servers[0]
+
+	injector.Partition([]string{"node_2"}, []string{"node_0", "node_1"})
+	waitFor(t, func() bool { return len(s.peerList()) == 1 })
+
+	// node_2 still owns the key, so a quorum of all the owners can't be reached.
+	s.WriteQuorum = 3
+	err := s.Store("foo", bytes.NewReader([]byte("bar")))
+
+	var quorumErr *WriteQuorumError
+	if !errors.As(err, &quorumErr) {
+		t.Fatalf("expected a write quorum error, got %v", err)
+	}
+	if quorumErr.Acked != 2 {
+		t.Errorf("expected 2 acknowledgements, got %d", quorumErr.Acked)
+	}
+	if _, ok := quorumErr.Failed["node_2"]; !ok || len(quorumErr.Failed) != 1 {
+		t.Errorf("expected only node_2 to fail, got %v", quorumErr.Failed)
+	}
+
+	// The writer acknowledged the write for itself with the same replica the
+	// other owner keeps.
+	want, err := servers[1].store.ReadMeta(s.ID, hashKey("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := s.store.ReadMeta(s.ID, hashKey("foo"))
+	if err != nil || meta.Version == 0 || !reflect.DeepEqual(meta, want) {
+		t.Errorf("expected the replica %+v on the writer, got %+v (%v)", want, meta, err)
+	}
+	if !s.store.Has(s.ID, hashKey("foo")) {
+		t.Error("expected the writer to have a replica of the file")
+	}
+}
+
+func TestFileServerReadRepair(t *testing.T) {
+	servers := makeMemCluster(t, 5)
+	s := servers[0]
+	s.ReadQuorum = 3
+
+	// Pick a key that is owned by three other nodes, so all of them are read.
+	var key string
+	for i := 0; len(key) == 0; i++ {
+		key = fmt.Sprintf("picture_%d.jpg", i)
+		if len(s.remoteOwners(key)) != 3 {
+			key = ""
+		}
+	}
+
+	byID := make(map[string]*FileServer)
+	for _, other := range servers {
+		byID[other.ID] = other
+	}
+	var owners []*FileServer
+	for _, owner := range s.remoteOwners(key) {
+		owners = append(owners, byID[owner.ID])
+	}
+
+	data := []byte("my big data file here!")
+	if err := s.Store(key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	for _, owner := range owners {
+		waitFor(t, func() bool { return owner.store.Has(s.ID, hashKey(key)) })
+	}
+	want, err := owners[0].store.ReadMeta(s.ID, hashKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One owner lost its replica, and another one has an older version.
+	if err := owners[1].store.Delete(s.ID, hashKey(key)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := owners[2].store.Write(s.ID, hashKey(key), bytes.NewReader([]byte("old data"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := owners[2].store.WriteMeta(s.ID, hashKey(key), FileMeta{Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	dropLocalCopy(t, s, key)
+
+	r, err := s.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := readAll(t, r); !bytes.Equal(b, data) {
+		t.Errorf("expected %s, got %s", data, b)
+	}
+
+	// Reading the file repairs the replicas of both of them.
+	for _, owner := range owners[1:] {
+		waitFor(t, func() bool {
+			meta, err := owner.store.ReadMeta(s.ID, hashKey(key))
+			return err == nil && meta.Version == want.Version && bytes.Equal(meta.Checksum, want.Checksum)
+		})
+	}
+}
+
+func TestFileServerDelete(t *testing.T) {
+	servers := makeMemCluster(t, 4)
+	s := servers[0]
+	s.ReadQuorum = 3
+
+	byID := make(map[string]*FileServer)
+	for _, other := range servers {
+		byID[other.ID] = other
+	}
+
+	key := "picture.jpg"
+	data := []byte("my big data file here!")
+	if err := s.Store(key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	var owners []*FileServer
+	for _, owner := range s.remoteOwners(key) {
+		owners = append(owners, byID[owner.ID])
+	}
+	for _, owner := range owners {
+		waitFor(t, func() bool { return owner.store.Has(s.ID, hashKey(key)) })
+	}
+	stored, err := owners[0].store.ReadMeta(s.ID, hashKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every owner is left with a tombstone.
+	for _, owner := range owners {
+		waitFor(t, func() bool {
+			meta, err := owner.store.ReadMeta(s.ID, hashKey(key))
+			return err == nil && meta.Deleted && !owner.store.Has(s.ID, hashKey(key))
+		})
+	}
+	// So is the writer, when it owns the key.
+	if s.owns(s.ID, hashKey(key)) {
+		meta, err := s.store.ReadMeta(s.ID, hashKey(key))
+		if err != nil || !meta.Deleted || s.store.Has(s.ID, hashKey(key)) {
+			t.Errorf("expected the writer to be left with a tombstone, got %+v (%v)", meta, err)
+		}
+	}
+
+	// An owner that missed the delete can't bring the file back, it is
+	// deleted from it once the file is read.
+	lagging := owners[0]
+	if err := lagging.store.Delete(s.ID, hashKey(key)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lagging.store.Write(s.ID, hashKey(key), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := lagging.store.WriteMeta(s.ID, hashKey(key), stored); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get(key); !errors.Is(err, errFileDeleted) {
+		t.Fatalf("expected the file to be deleted, got %v", err)
+	}
+	waitFor(t, func() bool { return !lagging.store.Has(s.ID, hashKey(key)) })
+}
+
+func TestFileServerAntiEntropy(t *testing.T) {
+	servers := makeMemCluster(t, 3)
+	s := servers[0]
+
+	stored := make(map[string]FileMeta)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("picture_%d.jpg", i)
+		if err := s.Store(key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	owners := []*FileServer{servers[1], servers[2]}
+	for i := 0; i < 10; i++ {
+		key := hashKey(fmt.Sprintf("picture_%d.jpg", i))
+		for _, owner := range owners {
+			waitFor(t, func() bool { return owner.store.Has(s.ID, key) })
+		}
+		meta, err := owners[1].store.ReadMeta(s.ID, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored[key] = meta
+	}
+
+	// One owner lost a replica and missed a delete.
+	lost := hashKey("picture_3.jpg")
+	if err := owners[0].store.Delete(s.ID, lost); err != nil {
+		t.Fatal(err)
+	}
+	deleted := hashKey("picture_7.jpg")
+	if err := owners[1].deleteReplica(s.ID, deleted, stored[deleted].Version+1); err != nil {
+		t.Fatal(err)
+	}
+
+	owners[0].antiEntropy()
+
+	meta, err := owners[0].store.ReadMeta(s.ID, lost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(meta, stored[lost]) {
+		t.Errorf("expected the lost replica to be restored with %+v, got %+v", stored[lost], meta)
+	}
+	if !owners[0].store.Has(s.ID, lost) {
+		t.Error("expected the lost replica to be restored")
+	}
+
+	meta, err = owners[0].store.ReadMeta(s.ID, deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Deleted || owners[0].store.Has(s.ID, deleted) {
+		t.Errorf("expected the replica to be deleted, got %+v", meta)
+	}
+}
+
+func TestFileServerHintedHandoff(t *testing.T) {
+	injector := p2p.NewFaultInjector(p2p.FaultOpts{Seed: 1})
+	servers := makeFaultyMemCluster(t, 3, map[int]*p2p.FaultInjector{
+		2: injector,
+	})
+	s := servers[0]
+
+	injector.Partition([]string{"node_2"}, []string{"node_0", "node_1"})
+	waitFor(t, func() bool { return len(s.peerList()) == 1 })
+
+	// node_2 misses the write, so node_0 keeps its replica as a hint.
+	key := "foo"
+	if err := s.Store(key, bytes.NewReader([]byte("bar"))); err != nil {
+		t.Fatal(err)
+	}
+	hints, err := s.hints.list(servers[2].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hints) != 1 {
+		t.Fatalf("expected a hint for node_2, got %d", len(hints))
+	}
+	want, err := servers[1].store.ReadMeta(s.ID, hashKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Once node_2 is back, the hint is delivered to it.
+	injector.Heal()
+	waitFor(t, func() bool {
+		meta, err := servers[2].store.ReadMeta(s.ID, hashKey(key))
+		return err == nil && reflect.DeepEqual(meta, want)
+	})
+	waitFor(t, func() bool {
+		hints, err := s.hints.list(servers[2].ID)
+		return err == nil && len(hints) == 0
+	})
+}
+
+func TestFileServerRereplicate(t *testing.T) {
+	injector := p2p.NewFaultInjector(p2p.FaultOpts{Seed: 1})
+	servers := makeFaultyMemCluster(t, 4, map[int]*p2p.FaultInjector{
+		3: injector,
+	})
+	s, left := servers[0], servers[3]
+
+	// Pick a key that is owned by the node that leaves and one of the nodes
+	// that stay, so another one has to take over its replica.
+	var key string
+	for i := 0; len(key) == 0; i++ {
+		key = fmt.Sprintf("picture_%d.jpg", i)
+
+		owners := make(map[string]bool)
+		for _, owner := range s.Owners(key) {
+			owners[owner.ID] = true
+		}
+		if !owners[s.ID] || !owners[left.ID] {
+			key = ""
+		}
+	}
+
+	if err := s.Store(key, bytes.NewReader([]byte("my big data file here!"))); err != nil {
+		t.Fatal(err)
+	}
+
+	injector.Partition([]string{"node_3"}, []string{"node_0", "node_1", "node_2"})
+	for _, other := range servers[:3] {
+		waitFor(t, func() bool { return other.memberState(left.ID) == MemberDead })
+	}
+
+	// Once the grace period is over, the replica is copied to the node
+	// that took over the key.
+	for _, other := range servers[:3] {
+		other.checkDepartures(0)
+	}
+
+	for _, owner := range s.Owners(key) {
+		if owner.ID == left.ID {
+			t.Fatal("expected the node that left to be removed from the ring")
+		}
+	}
+	for _, other := range servers[1:3] {
+		waitFor(t, func() bool { return other.store.Has(s.ID, hashKey(key)) })
+	}
+}
+
+func TestFileServerRereplicateToWriter(t *testing.T) {
+	network := p2p.NewMemNetwork()
+	injector := p2p.NewFaultInjector(p2p.FaultOpts{Seed: 1})
+
+	var servers []*FileServer
+	for i := 0; i < 4; i++ {
+		var faults *p2p.FaultInjector
+		if i == 3 {
+			faults = injector
+		}
+		s := makeMemServer(t, network, fmt.Sprintf("node_%d", i), faults)
+		s.ReplicationFactor, s.WriteQuorum = 2, 2
+		for _, remote := range servers {
+			s.BootstrapNodes = append(s.BootstrapNodes, remote.Transport.Addr())
+		}
+		go s.Start()
+		t.Cleanup(s.Stop)
+		servers = append(servers, s)
+	}
+	for _, s := range servers {
+		waitFor(t, func() bool { return len(s.knownNodes()) == 3 })
+	}
+	s, left := servers[0], servers[3]
+
+	// Pick a key the writer doesn't own, until the node that leaves is gone.
+	var stay []PeerInfo
+	for _, node := range s.members() {
+		if node.ID != left.ID {
+			stay = append(stay, node)
+		}
+	}
+	after := newHashRing(stay, s.VirtualNodes)
+
+	var key string
+	for i := 0; len(key) == 0; i++ {
+		key = fmt.Sprintf("picture_%d.jpg", i)
+
+		before := make(map[string]bool)
+		for _, owner := range s.Owners(key) {
+			before[owner.ID] = true
+		}
+		var writerAfter bool
+		for _, owner := range after.owners(hashKey(key), 2) {
+			writerAfter = writerAfter || owner.ID == s.ID
+		}
+		if before[s.ID] || !before[left.ID] || !writerAfter {
+			key = ""
+		}
+	}
+
+	if err := s.Store(key, bytes.NewReader([]byte("my big data file here!"))); err != nil {
+		t.Fatal(err)
+	}
+
+	injector.Partition([]string{"node_3"}, []string{"node_0", "node_1", "node_2"})
+	for _, other := range servers[:3] {
+		waitFor(t, func() bool { return other.memberState(left.ID) == MemberDead })
+	}
+	for _, other := range servers[:3] {
+		other.checkDepartures(0)
+	}
+
+	// The writer took over the key, and is sent a replica just like any
+	// other owner, so there are two replicas again.
+	waitFor(t, func() bool { return s.store.Has(s.ID, hashKey(key)) })
+	var replicas int
+	for _, other := range servers[:3] {
+		if other.store.Has(s.ID, hashKey(key)) {
+			replicas++
+		}
+	}
+	if replicas != 2 {
+		t.Errorf("expected 2 replicas, got %d", replicas)
+	}
+}
+
+func TestFileServerRebalance(t *testing.T) {
+	network := p2p.NewMemNetwork()
+
+	var servers []*FileServer
+	for i := 0; i < 3; i++ {
+		servers = append(servers, startMemServer(t, network, servers, nil))
+	}
+	for _, s := range servers {
+		waitFor(t, func() bool { return len(s.knownNodes()) == 2 })
+	}
+	s := servers[0]
+
+	var keys []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("picture_%d.jpg", i)
+		if err := s.Store(key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+
+	// The node that joins takes over some of the keys, of which the
+	// replicas are moved to it.
+	servers = append(servers, startMemServer(t, network, servers, nil))
+	for _, s := range servers {
+		waitFor(t, func() bool { return len(s.knownNodes()) == 3 })
+	}
+
+	for _, key := range keys {
+		owners := make(map[string]bool)
+		for _, owner := range s.Owners(key) {
+			owners[owner.ID] = true
+		}
+
+		// Every owner has a replica, the one that stored the file as well,
+		// and the surplus replicas are gone.
+		for _, other := range servers {
+			want := owners[other.ID]
+			waitFor(t, func() bool { return other.store.Has(s.ID, hashKey(key)) == want })
+		}
+	}
+
+	var moved int
+	for _, other := range servers[1:3] {
+		waitFor(t, func() bool {
+			for _, status := range other.Rebalances() {
+				if !status.Done {
+					return false
+				}
+			}
+			return true
+		})
+		for _, status := range other.Rebalances() {
+			if status.Node == "node_3" {
+				moved += status.Moved
+			}
+		}
+	}
+	if moved == 0 {
+		t.Error("expected replicas to be moved to the node that joined")
+	}
+}
+
+func TestFileServerMembers(t *testing.T) {
+	injector := p2p.NewFaultInjector(p2p.FaultOpts{Seed: 1})
+	servers := makeFaultyMemCluster(t, 3, map[int]*p2p.FaultInjector{
+		2: injector,
+	})
+	s := servers[0]
+
+	members := s.Members()
+	if len(members) != 3 {
+		t.Fatalf("expected 3 members, got %+v", members)
+	}
+	for _, m := range members {
+		if m.State != MemberAlive {
+			t.Errorf("expected %s to be alive, got %s", m.ListenAddr, m.State)
+		}
+	}
+
+	// node_2 stops answering its probes, it is suspected and then declared
+	// dead.
+	injector.Partition([]string{"node_2"}, []string{"node_0", "node_1"})
+	for _, other := range servers[:2] {
+		waitFor(t, func() bool { return other.memberState(servers[2].ID) == MemberDead })
+	}
+
+	// Dead owners are skipped, and get a hint instead.
+	key := "foo"
+	if err := s.Store(key, bytes.NewReader([]byte("bar"))); err != nil {
+		t.Fatal(err)
+	}
+	hints, err := s.hints.list(servers[2].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hints) != 1 {
+		t.Errorf("expected a hint for the dead owner, got %d", len(hints))
+	}
+
+	// Once it is back, node_2 refutes that it is dead.
+	injector.Heal()
+	for _, other := range servers[:2] {
+		waitFor(t, func() bool { return other.memberState(servers[2].ID) == MemberAlive })
+	}
+}
@@ -2,17 +2,26 @@ package main
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 const defaultRootFolderName = "storage"
 
+// chunksFolderName is the folder in the root of the store the chunks are in.
+const chunksFolderName = "chunks"
+
 func CASPathTransformFunc(key string) PathKey {
 	hash := sha1.Sum([]byte(key))
 	hashStr := hex.EncodeToString(hash[:])
@@ -64,8 +73,16 @@ var DefaultPathTransformFunc = func(key string) PathKey {
 	}
 }
 
+// Store keeps every file as a manifest, which lists the chunks the content of
+// the file was cut in. The chunks are stored by their SHA-256 hash, so a
+// chunk that is part of several files or versions is only stored once.
 type Store struct {
 	StoreOpts
+
+	// chunkLock is held for reading while chunks are written and referenced
+	// by a manifest, and for writing while the unreferenced chunks are
+	// collected.
+	chunkLock sync.RWMutex
 }
 
 func NewStore(opts StoreOpts) *Store {
@@ -75,13 +92,20 @@ func NewStore(opts StoreOpts) *Store {
 	if len(opts.Root) == 0 {
 		opts.Root = defaultRootFolderName
 	}
-	return &Store{opts}
+	return &Store{StoreOpts: opts}
 }
 
-func (s *Store) Has(id string, key string) bool {
+func (s *Store) manifestPath(id string, key string) string {
 	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := s.Root + "/" + id + "/" + pathKey.FullPath()
-	_, err := os.Stat(fullPathWithRoot)
+	return s.Root + "/" + id + "/" + pathKey.FullPath() + ".manifest"
+}
+
+func (s *Store) chunkPath(hash string) string {
+	return filepath.Join(s.Root, chunksFolderName, hash[:2], hash)
+}
+
+func (s *Store) Has(id string, key string) bool {
+	_, err := os.Stat(s.manifestPath(id, key))
 	return !errors.Is(err, os.ErrNotExist)
 }
 
@@ -100,45 +124,346 @@ func (s *Store) Delete(id string, key string) error {
 	return os.RemoveAll(firstPathNameWithRoot)
 }
 
+// FileMeta is what the store keeps about a replica next to its content.
+type FileMeta struct {
+	// Version orders the writes of a file, the highest one is the newest.
+	Version int64
+	// Checksum is the SHA-256 checksum of the content of the replica.
+	Checksum []byte
+	// Deleted marks a tombstone, which is left behind when the file is
+	// deleted so an older version of it can't be stored again.
+	Deleted bool
+}
+
+func (s *Store) metaPath(id string, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return s.Root + "/" + id + "/" + pathKey.FullPath() + ".meta"
+}
+
+// StoreEntry is a file in the store of which the metadata is known.
+type StoreEntry struct {
+	ID  string
+	Key string
+	FileMeta
+}
+
+// metaFile is how the metadata is written to disk. The key is kept as bytes,
+// since a hashed key is not valid UTF-8.
+type metaFile struct {
+	ID  string
+	Key []byte
+	FileMeta
+}
+
+// WriteMeta stores the metadata of the file, next to the file if it exists.
+func (s *Store) WriteMeta(id string, key string, meta FileMeta) error {
+	b, err := json.Marshal(metaFile{ID: id, Key: []byte(key), FileMeta: meta})
+	if err != nil {
+		return err
+	}
+
+	pathKey := s.PathTransformFunc(key)
+	if err := os.MkdirAll(s.Root+"/"+id+"/"+pathKey.PathName, os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(s.metaPath(id, key), b, 0644)
+}
+
+// ReadMeta returns the metadata of the file. Files that were stored without
+// any metadata have the zero FileMeta.
+func (s *Store) ReadMeta(id string, key string) (FileMeta, error) {
+	var meta metaFile
+
+	b, err := os.ReadFile(s.metaPath(id, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return meta.FileMeta, nil
+	}
+	if err != nil {
+		return meta.FileMeta, err
+	}
+
+	err = json.Unmarshal(b, &meta)
+	return meta.FileMeta, err
+}
+
+// Entries returns every file in the store that has metadata, tombstones
+// included.
+func (s *Store) Entries() ([]StoreEntry, error) {
+	var entries []StoreEntry
+
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path == filepath.Join(s.Root, chunksFolderName) {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".meta") {
+			return nil
+		}
+
+		b, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			// Deleted while we were walking the store.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var meta metaFile
+		if err := json.Unmarshal(b, &meta); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		entries = append(entries, StoreEntry{ID: meta.ID, Key: string(meta.Key), FileMeta: meta.FileMeta})
+		return nil
+	})
+
+	return entries, err
+}
+
 func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
 	return s.writeStream(id, key, r)
 }
 
+// WriteDecrypt decrypts everything that is read from r before it is stored,
+// and returns the number of encrypted bytes that were read.
 func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
-	if err != nil {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	nch := make(chan int, 1)
+	go func() {
+		n, err := copyDecrypt(encKey, r, pw)
+		nch <- n
+		pw.CloseWithError(err)
+	}()
+
+	if _, err := s.writeStream(id, key, pr); err != nil {
+		// Stop the decryption, in case it is still going.
+		pr.CloseWithError(err)
+		<-nch
 		return 0, err
 	}
 
-	n, err := copyDecrypt(encKey, r, f)
+	return int64(<-nch), nil
+}
+
+// Manifest lists the chunks of a file, in order.
+type Manifest struct {
+	Size   int64
+	Chunks []ChunkRef
+}
+
+// ChunkRef is a chunk in a manifest.
+type ChunkRef struct {
+	// Hash is the hex encoded SHA-256 hash of the chunk.
+	Hash string
+	Size int64
+}
+
+// ReadManifest returns the manifest of the file.
+func (s *Store) ReadManifest(id string, key string) (Manifest, error) {
+	var manifest Manifest
+
+	b, err := os.ReadFile(s.manifestPath(id, key))
 	if err != nil {
-		return 0, err
+		return manifest, err
 	}
 
-	return int64(n), nil
+	err = json.Unmarshal(b, &manifest)
+	return manifest, err
 }
 
-func (s *Store) openFileForWriting(id string, key string) (*os.File, error) {
-	pathKey := s.PathTransformFunc(key)
-	pathKeyWithRoot := s.Root + "/" + id + "/" + pathKey.PathName
-	if err := os.MkdirAll(pathKeyWithRoot, os.ModePerm); err != nil {
-		return nil, err
+// HasChunk reports whether the chunk with the given hash is stored. A chunk
+// that is, is not collected as garbage for a while, as it is about to be
+// listed by a new manifest.
+func (s *Store) HasChunk(hash string) bool {
+	now := time.Now()
+	return os.Chtimes(s.chunkPath(hash), now, now) == nil
+}
+
+func newChunkRef(chunk []byte) ChunkRef {
+	hash := sha256.Sum256(chunk)
+	return ChunkRef{Hash: hex.EncodeToString(hash[:]), Size: int64(len(chunk))}
+}
+
+// chunkSize returns the size of the chunk with the given hash.
+func (s *Store) chunkSize(hash string) (int64, error) {
+	info, err := os.Stat(s.chunkPath(hash))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// writeChunk stores the chunk under its hash, unless it is stored already.
+func (s *Store) writeChunk(chunk []byte) (ChunkRef, error) {
+	ref := newChunkRef(chunk)
+
+	path := s.chunkPath(ref.Hash)
+	if s.HasChunk(ref.Hash) {
+		return ref, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return ref, err
+	}
+
+	// The chunk is written next to where it belongs first, so a chunk is
+	// never seen half written, also not when it is written twice at once.
+	f, err := os.CreateTemp(filepath.Dir(path), ref.Hash+".*")
+	if err != nil {
+		return ref, err
+	}
+	if _, err := f.Write(chunk); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return ref, err
 	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return ref, err
+	}
+	return ref, os.Rename(f.Name(), path)
+}
+
+// WriteChunk stores the chunk under its hash, before any manifest lists it.
+// The chunk is only collected as garbage once the grace period passed.
+func (s *Store) WriteChunk(chunk []byte) (ChunkRef, error) {
+	s.chunkLock.RLock()
+	defer s.chunkLock.RUnlock()
 
-	fullPathWithRoot := s.Root + "/" + id + "/" + pathKey.FullPath()
+	return s.writeChunk(chunk)
+}
 
-	return os.Create(fullPathWithRoot)
+// ReadChunk returns the chunk with the given hash.
+func (s *Store) ReadChunk(hash string) ([]byte, error) {
+	return os.ReadFile(s.chunkPath(hash))
 }
 
 func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
+	s.chunkLock.RLock()
+	defer s.chunkLock.RUnlock()
+
+	var (
+		manifest Manifest
+		chunker  = newChunker(r)
+	)
+	for {
+		chunk, err := chunker.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		ref, err := s.writeChunk(chunk)
+		if err != nil {
+			return 0, err
+		}
+		manifest.Chunks = append(manifest.Chunks, ref)
+		manifest.Size += ref.Size
+	}
+
+	return manifest.Size, s.writeManifest(id, key, manifest)
+}
+
+func (s *Store) writeManifest(id string, key string, manifest Manifest) error {
+	b, err := json.Marshal(manifest)
 	if err != nil {
-		return 0, err
+		return err
+	}
+
+	pathKey := s.PathTransformFunc(key)
+	if err := os.MkdirAll(s.Root+"/"+id+"/"+pathKey.PathName, os.ModePerm); err != nil {
+		return err
 	}
+	return os.WriteFile(s.manifestPath(id, key), b, 0644)
+}
+
+// ReadChunks calls fn with every chunk in the list, in order. The chunks at
+// the indexes in sent are read from r, one after another, and have to match
+// their hash. The other chunks were either sent before in the list, or are
+// read from the store.
+func (s *Store) ReadChunks(chunks []ChunkRef, sent []int, r io.Reader, fn func(ref ChunkRef, chunk []byte) error) error {
+	received := make(map[int]bool, len(sent))
+	for _, i := range sent {
+		received[i] = true
+	}
+
+	// repeated holds the chunks that were sent, and are listed again further on.
+	repeated := make(map[string][]byte)
+	for i, ref := range chunks {
+		if !received[i] {
+			repeated[ref.Hash] = nil
+		}
+	}
+
+	for i, ref := range chunks {
+		if !received[i] {
+			chunk := repeated[ref.Hash]
+			if chunk == nil {
+				var err error
+				if chunk, err = s.ReadChunk(ref.Hash); err != nil {
+					return fmt.Errorf("missing chunk %s: %w", ref.Hash, err)
+				}
+			}
+			if err := fn(ref, chunk); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if ref.Size < 0 || ref.Size > maxChunkSize {
+			return fmt.Errorf("chunk %s of %d bytes is too large", ref.Hash, ref.Size)
+		}
+		chunk := make([]byte, ref.Size)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return err
+		}
+		if newChunkRef(chunk).Hash != ref.Hash {
+			return fmt.Errorf("chunk %s doesn't match its hash", ref.Hash)
+		}
+		if _, ok := repeated[ref.Hash]; ok {
+			repeated[ref.Hash] = chunk
+		}
+		if err := fn(ref, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	defer f.Close()
+// WriteChunks stores the file with the given chunks, of which the ones at the
+// indexes in sent are read from r and the others have to be stored already.
+// It returns the size and SHA-256 checksum of the content of the file.
+func (s *Store) WriteChunks(id string, key string, chunks []ChunkRef, sent []int, r io.Reader) (int64, []byte, error) {
+	s.chunkLock.RLock()
+	defer s.chunkLock.RUnlock()
+
+	var (
+		manifest Manifest
+		hash     = sha256.New()
+	)
+	err := s.ReadChunks(chunks, sent, r, func(_ ChunkRef, chunk []byte) error {
+		ref, err := s.writeChunk(chunk)
+		if err != nil {
+			return err
+		}
+		hash.Write(chunk)
+		manifest.Chunks = append(manifest.Chunks, ref)
+		manifest.Size += ref.Size
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
 
-	return io.Copy(f, r)
+	return manifest.Size, hash.Sum(nil), s.writeManifest(id, key, manifest)
 }
 
 func (s *Store) Read(id string, key string) (int64, io.Reader, error) {
@@ -146,17 +471,118 @@ func (s *Store) Read(id string, key string) (int64, io.Reader, error) {
 }
 
 func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error) {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := s.Root + "/" + id + "/" + pathKey.FullPath()
-	file, err := os.Open(fullPathWithRoot)
+	manifest, err := s.ReadManifest(id, key)
 	if err != nil {
 		return 0, nil, err
 	}
 
-	fi, err := file.Stat()
+	return manifest.Size, &chunkReader{store: s, chunks: manifest.Chunks}, nil
+}
+
+// chunkReader reads the chunks of a manifest one after another.
+type chunkReader struct {
+	store  *Store
+	chunks []ChunkRef
+	chunk  *os.File
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	for {
+		if r.chunk == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+
+			f, err := os.Open(r.store.chunkPath(r.chunks[0].Hash))
+			if err != nil {
+				return 0, err
+			}
+			r.chunk, r.chunks = f, r.chunks[1:]
+		}
+
+		n, err := r.chunk.Read(b)
+		if err == io.EOF {
+			r.chunk.Close()
+			r.chunk = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.chunk == nil {
+		return nil
+	}
+	err := r.chunk.Close()
+	r.chunk = nil
+	return err
+}
+
+// CollectGarbage removes the chunks that are not listed by any manifest
+// anymore, and weren't used within the grace period. It returns how many
+// chunks it removed.
+func (s *Store) CollectGarbage(grace time.Duration) (int, error) {
+	s.chunkLock.Lock()
+	defer s.chunkLock.Unlock()
+
+	chunksRoot := filepath.Join(s.Root, chunksFolderName)
+	referenced := make(map[string]bool)
+
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path == chunksRoot {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".manifest") {
+			return nil
+		}
+
+		b, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var manifest Manifest
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		for _, ref := range manifest.Chunks {
+			referenced[ref.Hash] = true
+		}
+		return nil
+	})
 	if err != nil {
-		return 0, nil, err
+		return 0, err
 	}
 
-	return fi.Size(), file, nil
+	removed := 0
+	err = filepath.WalkDir(chunksRoot, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil || d.IsDir() || referenced[d.Name()] {
+			return err
+		}
+		if info, err := d.Info(); err != nil || time.Since(info.ModTime()) < grace {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
 }
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"math/rand"
+	"path/filepath"
 	"testing"
 )
 
@@ -72,3 +74,108 @@ func teardownStore(t *testing.T, s *Store) {
 		t.Error(err)
 	}
 }
+
+func TestStoreMeta(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardownStore(t, s)
+
+	key := "foo"
+	if _, err := s.Write(id, key, bytes.NewReader([]byte("bar"))); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := s.ReadMeta(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Version != 0 || meta.Checksum != nil {
+		t.Errorf("expected no metadata, got %+v", meta)
+	}
+
+	want := FileMeta{Version: 42, Checksum: []byte("checksum")}
+	if err := s.WriteMeta(id, key, want); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err = s.ReadMeta(id, key); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Version != want.Version || !bytes.Equal(meta.Checksum, want.Checksum) {
+		t.Errorf("expected %+v, got %+v", want, meta)
+	}
+
+	entries, err := s.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != id || entries[0].Key != key || entries[0].Version != want.Version {
+		t.Errorf("expected a single entry for %s, got %+v", key, entries)
+	}
+}
+
+// countChunks returns the number of chunks in the store.
+func countChunks(t *testing.T, s *Store) int {
+	files, err := filepath.Glob(filepath.Join(s.Root, chunksFolderName, "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+func TestStoreChunks(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardownStore(t, s)
+
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	if _, err := s.Write(id, "foo", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	chunks := countChunks(t, s)
+
+	// A new version with a few bytes changed shares nearly all of its chunks
+	// with the first one, and only the chunks of the old version that are
+	// not shared are collected.
+	edited := append([]byte{}, data...)
+	copy(edited[len(edited)/2:], "bar")
+	if _, err := s.Write(id, "foo", bytes.NewReader(edited)); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks(t, s); n > chunks+2 {
+		t.Errorf("expected at most %d chunks, got %d", chunks+2, n)
+	}
+	if n, err := s.CollectGarbage(0); err != nil || n == 0 || n > 2 {
+		t.Errorf("expected 1 or 2 unused chunks, got %d (%v)", n, err)
+	}
+
+	// A copy under another key doesn't take any more chunks.
+	chunks = countChunks(t, s)
+	if _, err := s.Write(id, "baz", bytes.NewReader(edited)); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks(t, s); n != chunks {
+		t.Errorf("expected %d chunks, got %d", chunks, n)
+	}
+
+	_, r, err := s.Read(id, "baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.(io.ReadCloser).Close()
+	if !bytes.Equal(b, edited) {
+		t.Error("expected to read the copy")
+	}
+
+	// Once both files are gone, all of the chunks are.
+	s.Delete(id, "foo")
+	s.Delete(id, "baz")
+	if _, err := s.CollectGarbage(0); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks(t, s); n != 0 {
+		t.Errorf("expected no chunks left, got %d", n)
+	}
+}
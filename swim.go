@@ -0,0 +1,528 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProbeInterval    = time.Second
+	defaultProbeTimeout     = 500 * time.Millisecond
+	defaultIndirectProbes   = 3
+	defaultSuspicionTimeout = 5 * time.Second
+)
+
+var errMemberDead = errors.New("member is dead")
+
+type MemberState int
+
+const (
+	MemberAlive MemberState = iota
+	MemberSuspect
+	MemberDead
+)
+
+func (s MemberState) String() string {
+	switch s {
+	case MemberAlive:
+		return "alive"
+	case MemberSuspect:
+		return "suspect"
+	case MemberDead:
+		return "dead"
+	}
+	return fmt.Sprintf("MemberState(%d)", int(s))
+}
+
+// Member is what we know about a node of the cluster. It is also what is
+// gossiped about the node, the update with the highest Incarnation wins, and
+// with the same Incarnation the worst State wins. Only the node itself raises
+// its Incarnation, to refute that it is suspected or dead.
+type Member struct {
+	ID          string
+	ListenAddr  string
+	State       MemberState
+	Incarnation uint64
+}
+
+// MessagePing probes a member, which answers with a MessagePingAck.
+type MessagePing struct {
+	Updates []Member
+}
+
+// MessagePingReq asks a member to probe the target for us, because we got no
+// answer from it ourselves. The member answers with a MessagePingAck of which
+// Ok tells whether the target answered.
+type MessagePingReq struct {
+	Target  PeerInfo
+	Updates []Member
+}
+
+type MessagePingAck struct {
+	Ok      bool
+	Updates []Member
+}
+
+// memberChange is a change of the state of a member. A member joined when it
+// was new to us or dead before, which puts it on the hash ring.
+type memberChange struct {
+	Member
+	joined bool
+}
+
+type memberEntry struct {
+	Member
+	// since is when the member got its current state.
+	since time.Time
+}
+
+// memberList is the SWIM membership of a node: the state of every member it
+// knows about, and the updates that still have to be gossiped.
+type memberList struct {
+	self PeerInfo
+
+	lock        sync.Mutex
+	incarnation uint64
+	members     map[string]*memberEntry
+	// gossip holds how many more times the latest update about a member, by
+	// its ID, is piggybacked on our messages.
+	gossip map[string]int
+	// order is the round-robin order in which the members are probed.
+	order []string
+	next  int
+	rng   *rand.Rand
+}
+
+func newMemberList(self PeerInfo) *memberList {
+	return &memberList{
+		self:    self,
+		members: make(map[string]*memberEntry),
+		gossip:  make(map[string]int),
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// retransmits is the number of times an update is gossiped, which grows with
+// the log of the size of the cluster so every member hears about it. Must be
+// called with the lock held.
+func (l *memberList) retransmits() int {
+	return 3 * int(math.Ceil(math.Log2(float64(len(l.members)+2))))
+}
+
+// apply merges the updates into the list, and returns the members of which the
+// state changed.
+func (l *memberList) apply(updates []Member) []memberChange {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var changed []memberChange
+	for _, update := range updates {
+		if update.ID == l.self.ID {
+			// We are suspected or declared dead, refute it with an
+			// incarnation that overrides the rumour. A rumour we refuted
+			// already is still going around, so it is refuted again.
+			if update.State != MemberAlive {
+				if update.Incarnation >= l.incarnation {
+					l.incarnation = update.Incarnation + 1
+				}
+				l.gossip[l.self.ID] = l.retransmits()
+			}
+			continue
+		}
+
+		m, ok := l.members[update.ID]
+		if ok && !overrides(update, m.Member) {
+			continue
+		}
+		if !ok {
+			m = &memberEntry{}
+			l.members[update.ID] = m
+		}
+
+		var (
+			stateChanged = !ok || m.State != update.State
+			joined       = (!ok || m.State == MemberDead) && update.State != MemberDead
+		)
+		m.Member = update
+		if stateChanged {
+			m.since = time.Now()
+			changed = append(changed, memberChange{Member: update, joined: joined})
+		}
+		l.gossip[update.ID] = l.retransmits()
+	}
+	return changed
+}
+
+// overrides reports whether the update is newer than what we know about the
+// member.
+func overrides(update Member, current Member) bool {
+	if update.Incarnation != current.Incarnation {
+		return update.Incarnation > current.Incarnation
+	}
+	return update.State > current.State
+}
+
+// join adds the node as an alive member, when we don't know it yet.
+func (l *memberList) join(node PeerInfo) []memberChange {
+	l.lock.Lock()
+	_, ok := l.members[node.ID]
+	l.lock.Unlock()
+
+	if ok || node.ID == l.self.ID {
+		return nil
+	}
+	return l.apply([]Member{{ID: node.ID, ListenAddr: node.ListenAddr, State: MemberAlive}})
+}
+
+// mark changes the state of the member, at its current incarnation.
+func (l *memberList) mark(id string, state MemberState) []memberChange {
+	l.lock.Lock()
+	m, ok := l.members[id]
+	var update Member
+	if ok {
+		update = m.Member
+		update.State = state
+	}
+	l.lock.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return l.apply([]Member{update})
+}
+
+// expired returns the suspects that didn't refute the suspicion in time.
+func (l *memberList) expired(timeout time.Duration) []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var ids []string
+	for id, m := range l.members {
+		if m.State == MemberSuspect && time.Since(m.since) >= timeout {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// updates returns the updates to piggyback on the next message, with the
+// latest state of the receiver when it is not alive, so it can refute it.
+func (l *memberList) updates(to string) []Member {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var updates []Member
+	for id, left := range l.gossip {
+		if id == l.self.ID {
+			updates = append(updates, Member{ID: id, ListenAddr: l.self.ListenAddr, State: MemberAlive, Incarnation: l.incarnation})
+		} else if m, ok := l.members[id]; ok {
+			updates = append(updates, m.Member)
+		}
+
+		if left <= 1 {
+			delete(l.gossip, id)
+		} else {
+			l.gossip[id] = left - 1
+		}
+	}
+
+	if m, ok := l.members[to]; ok && m.State != MemberAlive {
+		updates = append(updates, m.Member)
+	}
+	return updates
+}
+
+// state returns the state of the member.
+func (l *memberList) state(id string) (MemberState, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if id == l.self.ID {
+		return MemberAlive, true
+	}
+	m, ok := l.members[id]
+	if !ok {
+		return MemberAlive, false
+	}
+	return m.State, true
+}
+
+// view returns every member, ourselves included, ordered by ID.
+func (l *memberList) view() []Member {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	members := []Member{{ID: l.self.ID, ListenAddr: l.self.ListenAddr, State: MemberAlive, Incarnation: l.incarnation}}
+	for _, m := range l.members {
+		members = append(members, m.Member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+	return members
+}
+
+// nextTarget returns the next member to probe. Every member that is not dead
+// is probed once per round, in an order that is shuffled every round.
+func (l *memberList) nextTarget() (PeerInfo, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for {
+		if l.next >= len(l.order) {
+			l.order = l.order[:0]
+			for id, m := range l.members {
+				if m.State != MemberDead {
+					l.order = append(l.order, id)
+				}
+			}
+			if len(l.order) == 0 {
+				return PeerInfo{}, false
+			}
+			sort.Strings(l.order)
+			l.rng.Shuffle(len(l.order), func(i, j int) {
+				l.order[i], l.order[j] = l.order[j], l.order[i]
+			})
+			l.next = 0
+		}
+
+		m, ok := l.members[l.order[l.next]]
+		l.next++
+		if ok && m.State != MemberDead {
+			return PeerInfo{ID: m.ID, ListenAddr: m.ListenAddr}, true
+		}
+	}
+}
+
+// random returns at most n alive members other than the one with the given ID.
+func (l *memberList) random(n int, except string) []PeerInfo {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var alive []PeerInfo
+	for id, m := range l.members {
+		if id != except && m.State == MemberAlive {
+			alive = append(alive, PeerInfo{ID: m.ID, ListenAddr: m.ListenAddr})
+		}
+	}
+	sort.Slice(alive, func(i, j int) bool {
+		return alive[i].ID < alive[j].ID
+	})
+	l.rng.Shuffle(len(alive), func(i, j int) {
+		alive[i], alive[j] = alive[j], alive[i]
+	})
+	if len(alive) > n {
+		alive = alive[:n]
+	}
+	return alive
+}
+
+// Members returns the membership view of the server: every node it knows
+// about, itself included, with its state.
+func (s *FileServer) Members() []Member {
+	return s.memberList.view()
+}
+
+// memberState returns the state of the node in the membership view, nodes
+// that are not in the view yet are assumed to be alive.
+func (s *FileServer) memberState(id string) MemberState {
+	state, _ := s.memberList.state(id)
+	return state
+}
+
+// liveOwners splits the owners in the ones that are not dead, the alive ones
+// first, and the ones that are.
+func (s *FileServer) liveOwners(owners []PeerInfo) (live []PeerInfo, dead []PeerInfo) {
+	var suspect []PeerInfo
+	for _, owner := range owners {
+		switch s.memberState(owner.ID) {
+		case MemberAlive:
+			live = append(live, owner)
+		case MemberSuspect:
+			suspect = append(suspect, owner)
+		default:
+			dead = append(dead, owner)
+		}
+	}
+	return append(live, suspect...), dead
+}
+
+// membersChanged acts on the members of which the state changed. A member
+// that died departed the cluster, and one that is alive again is back. A
+// member that joined takes over some of the keys.
+func (s *FileServer) membersChanged(changed []memberChange) {
+	for _, m := range changed {
+		log.Printf("[%s] member %s is %s\n", s.Transport.Addr(), m.ListenAddr, m.State)
+
+		s.peerLock.Lock()
+		switch m.State {
+		case MemberDead:
+			if _, ok := s.departures[m.ID]; !ok {
+				s.departures[m.ID] = departure{
+					node: PeerInfo{ID: m.ID, ListenAddr: m.ListenAddr},
+					at:   time.Now(),
+				}
+			}
+		case MemberAlive:
+			delete(s.departures, m.ID)
+		}
+		s.peerLock.Unlock()
+
+		if m.joined {
+			go s.rebalance(PeerInfo{ID: m.ID, ListenAddr: m.ListenAddr})
+		}
+	}
+}
+
+func (s *FileServer) probeLoop() {
+	ticker := time.NewTicker(s.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.probe()
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// probe runs a protocol period of SWIM. The next member is pinged, and when
+// it doesn't answer in time, a few other members are asked to ping it. When
+// none of them gets an answer either, the member is suspected. Suspects that
+// didn't refute the suspicion within the SuspicionTimeout are declared dead.
+func (s *FileServer) probe() {
+	for _, id := range s.memberList.expired(s.SuspicionTimeout) {
+		s.membersChanged(s.memberList.mark(id, MemberDead))
+	}
+
+	target, ok := s.memberList.nextTarget()
+	if !ok {
+		return
+	}
+
+	if s.ping(target) {
+		return
+	}
+
+	var (
+		relays = s.memberList.random(s.IndirectProbes, target.ID)
+		acks   = make(chan bool, len(relays))
+	)
+	for _, relay := range relays {
+		go func(relay PeerInfo) {
+			msg, err := s.callWithin(relay, MessagePingReq{Target: target, Updates: s.memberList.updates(relay.ID)}, 2*s.ProbeTimeout)
+			if err != nil {
+				acks <- false
+				return
+			}
+			ack, ok := msg.Payload.(MessagePingAck)
+			if ok {
+				s.membersChanged(s.memberList.apply(ack.Updates))
+			}
+			acks <- ok && ack.Ok
+		}(relay)
+	}
+	for range relays {
+		if <-acks {
+			return
+		}
+	}
+
+	s.membersChanged(s.memberList.mark(target.ID, MemberSuspect))
+}
+
+// ping sends a MessagePing to the node, and reports whether it answered in
+// time.
+func (s *FileServer) ping(node PeerInfo) bool {
+	msg, err := s.callWithin(node, MessagePing{Updates: s.memberList.updates(node.ID)}, s.ProbeTimeout)
+	if err != nil {
+		return false
+	}
+	ack, ok := msg.Payload.(MessagePingAck)
+	if !ok {
+		return false
+	}
+	s.membersChanged(s.memberList.apply(ack.Updates))
+	return true
+}
+
+// callWithin is call, which gives up on the response after the timeout.
+func (s *FileServer) callWithin(c PeerInfo, payload any, timeout time.Duration) (*Message, error) {
+	type result struct {
+		msg *Message
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		msg, err := s.call(c, payload)
+		ch <- result{msg, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-ch:
+		return r.msg, r.err
+	case <-timer.C:
+		return nil, fmt.Errorf("no response from %s within %s", c.ListenAddr, timeout)
+	}
+}
+
+// nodeID returns the ID of the node on the other end of the peer.
+func (s *FileServer) nodeID(from string) string {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	return s.nodes[from].ID
+}
+
+func (s *FileServer) handleMessagePing(from string, requestID uint64, msg MessagePing) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer not found: %s", from)
+	}
+
+	s.membersChanged(s.memberList.apply(msg.Updates))
+
+	resp := Message{
+		RequestID: requestID,
+		Payload: MessagePingAck{
+			Ok:      true,
+			Updates: s.memberList.updates(s.nodeID(from)),
+		},
+	}
+	return s.send(peer, &resp)
+}
+
+func (s *FileServer) handleMessagePingReq(from string, requestID uint64, msg MessagePingReq) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer not found: %s", from)
+	}
+
+	s.membersChanged(s.memberList.apply(msg.Updates))
+
+	// Pinging the target takes a while, so it can't block the loop.
+	go func() {
+		resp := Message{
+			RequestID: requestID,
+			Payload: MessagePingAck{
+				Ok:      s.ping(msg.Target),
+				Updates: s.memberList.updates(s.nodeID(from)),
+			},
+		}
+		if err := s.send(peer, &resp); err != nil {
+			log.Printf("[%s] failed to answer ping request: %s\n", s.Transport.Addr(), err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemberListApply(t *testing.T) {
+	l := newMemberList(PeerInfo{ID: "self", ListenAddr: ":3000"})
+	if changed := l.join(PeerInfo{ID: "a", ListenAddr: ":4000"}); len(changed) != 1 || !changed[0].joined {
+		t.Fatalf("expected a to join, got %v", changed)
+	}
+
+	tests := []struct {
+		update Member
+		want   MemberState
+		joined bool
+	}{
+		// A suspicion overrides alive at the same incarnation.
+		{Member{ID: "a", State: MemberSuspect, Incarnation: 0}, MemberSuspect, false},
+		// Alive only overrides it with a higher incarnation.
+		{Member{ID: "a", State: MemberAlive, Incarnation: 0}, MemberSuspect, false},
+		{Member{ID: "a", State: MemberAlive, Incarnation: 1}, MemberAlive, false},
+		// An old suspicion is ignored.
+		{Member{ID: "a", State: MemberSuspect, Incarnation: 0}, MemberAlive, false},
+		{Member{ID: "a", State: MemberDead, Incarnation: 1}, MemberDead, false},
+		{Member{ID: "a", State: MemberAlive, Incarnation: 1}, MemberDead, false},
+		// The member refuted that it is dead, and joined again.
+		{Member{ID: "a", State: MemberAlive, Incarnation: 2}, MemberAlive, true},
+	}
+	for i, tt := range tests {
+		changed := l.apply([]Member{tt.update})
+		if state, _ := l.state("a"); state != tt.want {
+			t.Errorf("%d: expected %s, got %s", i, tt.want, state)
+		}
+		if joined := len(changed) == 1 && changed[0].joined; joined != tt.joined {
+			t.Errorf("%d: expected joined to be %t, got %t", i, tt.joined, joined)
+		}
+	}
+}
+
+func TestMemberListRefute(t *testing.T) {
+	l := newMemberList(PeerInfo{ID: "self", ListenAddr: ":3000"})
+
+	l.apply([]Member{{ID: "self", State: MemberSuspect, Incarnation: 3}})
+
+	var refuted bool
+	for _, m := range l.updates("a") {
+		if m.ID == "self" && m.State == MemberAlive && m.Incarnation == 4 {
+			refuted = true
+		}
+	}
+	if !refuted {
+		t.Error("expected the suspicion to be refuted with a higher incarnation")
+	}
+}
+
+func TestMemberListExpired(t *testing.T) {
+	l := newMemberList(PeerInfo{ID: "self", ListenAddr: ":3000"})
+	l.join(PeerInfo{ID: "a", ListenAddr: ":4000"})
+	l.join(PeerInfo{ID: "b", ListenAddr: ":5000"})
+	l.mark("a", MemberSuspect)
+
+	if ids := l.expired(time.Hour); len(ids) != 0 {
+		t.Errorf("expected no expired suspects, got %v", ids)
+	}
+	if ids := l.expired(0); len(ids) != 1 || ids[0] != "a" {
+		t.Errorf("expected a to be expired, got %v", ids)
+	}
+}
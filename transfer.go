@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ZainAli104/distributed-file-system-go/p2p"
+	"io"
+)
+
+// Replicas are sent chunk by chunk. Before anything is sent, the receiving
+// side is told which chunks the replica is made of, and it answers with the
+// ones it doesn't have yet. Only those are sent, so a new version of a file
+// only costs the chunks that changed.
+
+// MessageHaveChunks asks which of the chunks, by their hash, the node is missing.
+type MessageHaveChunks struct {
+	Hashes []string
+}
+
+// MessageWantChunks answers a MessageHaveChunks with the indexes of the hashes
+// of the chunks the node is missing. A chunk that is listed more than once is
+// only wanted once.
+type MessageWantChunks struct {
+	Missing []int
+}
+
+// MessageGetChunks asks for the chunks with the given hashes.
+type MessageGetChunks struct {
+	Hashes []string
+}
+
+// MessageGetChunksResponse is the header of the stream of the chunks that
+// were asked for, in the order they were asked for. When the node doesn't
+// have all of them, nothing is sent.
+type MessageGetChunksResponse struct {
+	Found bool
+	Size  int64
+}
+
+// replicaChunks is the encrypted content of a replica, cut in the same chunks
+// the store of an owner keeps it in.
+type replicaChunks struct {
+	Manifest
+	// data holds the chunks by their hash, when the content is in memory.
+	// Otherwise the chunks are read from the store.
+	data  map[string][]byte
+	store *Store
+}
+
+// chunkBytes cuts the content in chunks.
+func chunkBytes(content []byte) replicaChunks {
+	var (
+		chunks  = replicaChunks{data: make(map[string][]byte)}
+		chunker = newChunker(bytes.NewReader(content))
+	)
+	for {
+		chunk, err := chunker.next()
+		if err != nil {
+			// Reading from memory can't fail, so this is io.EOF.
+			return chunks
+		}
+
+		ref := newChunkRef(chunk)
+		if _, ok := chunks.data[ref.Hash]; !ok {
+			chunks.data[ref.Hash] = append([]byte(nil), chunk...)
+		}
+		chunks.Chunks = append(chunks.Chunks, ref)
+		chunks.Size += ref.Size
+	}
+}
+
+// storedChunks returns the chunks of the replica in our store.
+func (s *FileServer) storedChunks(id string, key string) (replicaChunks, error) {
+	manifest, err := s.store.ReadManifest(id, key)
+	return replicaChunks{Manifest: manifest, store: s.store}, err
+}
+
+func chunkHashes(chunks []ChunkRef) []string {
+	hashes := make([]string, len(chunks))
+	for i, ref := range chunks {
+		hashes[i] = ref.Hash
+	}
+	return hashes
+}
+
+func (c replicaChunks) read(hash string) ([]byte, error) {
+	if c.data != nil {
+		return c.data[hash], nil
+	}
+	return c.store.ReadChunk(hash)
+}
+
+// size returns the number of bytes of the chunks at the indexes.
+func (c replicaChunks) size(indexes []int) int64 {
+	var size int64
+	for _, i := range indexes {
+		size += c.Chunks[i].Size
+	}
+	return size
+}
+
+// reader returns the chunks at the indexes one after another.
+func (c replicaChunks) reader(indexes []int) io.Reader {
+	return &replicaReader{chunks: c, indexes: indexes}
+}
+
+// content returns every chunk one after another, which is the whole content.
+func (c replicaChunks) content() io.Reader {
+	indexes := make([]int, len(c.Chunks))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	return c.reader(indexes)
+}
+
+// replicaReader reads the chunks one at a time, only once they are needed.
+type replicaReader struct {
+	chunks  replicaChunks
+	indexes []int
+	chunk   []byte
+}
+
+func (r *replicaReader) Read(b []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if len(r.indexes) == 0 {
+			return 0, io.EOF
+		}
+
+		chunk, err := r.chunks.read(r.chunks.Chunks[r.indexes[0]].Hash)
+		if err != nil {
+			return 0, err
+		}
+		r.chunk, r.indexes = chunk, r.indexes[1:]
+	}
+
+	n := copy(b, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// checkSentChunks verifies that the indexes of the chunks that are sent are
+// in order, and refer to the chunks of the file.
+func checkSentChunks(chunks []ChunkRef, sent []int) error {
+	for i, index := range sent {
+		if index < 0 || index >= len(chunks) || (i > 0 && index <= sent[i-1]) {
+			return fmt.Errorf("invalid chunk index %d of %d chunks", index, len(chunks))
+		}
+	}
+	return nil
+}
+
+// missingChunks returns the indexes of the chunks we don't have, every chunk
+// only once.
+func (s *FileServer) missingChunks(hashes []string) []int {
+	var (
+		missing []int
+		seen    = make(map[string]bool)
+	)
+	for i, hash := range hashes {
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+
+		if !s.store.HasChunk(hash) {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// wantedChunks asks the node on the other end of the peer which of the chunks
+// it is missing.
+func (s *FileServer) wantedChunks(peer p2p.Peer, chunks replicaChunks) ([]int, error) {
+	msg, err := s.callPeer(peer, MessageHaveChunks{Hashes: chunkHashes(chunks.Chunks)})
+	if err != nil {
+		return nil, err
+	}
+	want, ok := msg.Payload.(MessageWantChunks)
+	if !ok {
+		return nil, fmt.Errorf("unexpected response: %T", msg.Payload)
+	}
+
+	for _, i := range want.Missing {
+		if i < 0 || i >= len(chunks.Chunks) {
+			return nil, fmt.Errorf("wanted chunk %d of %d", i, len(chunks.Chunks))
+		}
+	}
+	return want.Missing, nil
+}
+
+// fetchChunks asks the node on the other end of the peer for the chunks at the
+// indexes, and returns the stream they are sent in. The stream has to be
+// closed once the chunks are read.
+func (s *FileServer) fetchChunks(peer p2p.Peer, chunks []ChunkRef, indexes []int) (io.ReadCloser, error) {
+	if len(indexes) == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	hashes := make([]string, len(indexes))
+	for i, index := range indexes {
+		hashes[i] = chunks[index].Hash
+	}
+
+	req := s.newRequest(1)
+	defer s.closeRequest(req)
+
+	msg := Message{
+		RequestID: req.id,
+		Payload:   MessageGetChunks{Hashes: hashes},
+	}
+	if s.requestPeers(req, []p2p.Peer{peer}, &msg) == 0 {
+		return nil, fmt.Errorf("failed to send request to %s", peer.RemoteAddr())
+	}
+
+	resp, err := req.wait()
+	if err != nil {
+		return nil, err
+	}
+	if resp.err != nil {
+		return nil, resp.err
+	}
+
+	v, ok := resp.msg.Payload.(MessageGetChunksResponse)
+	if !ok || !v.Found || resp.body == nil {
+		resp.discard()
+		return nil, fmt.Errorf("chunks not found")
+	}
+	return resp.body, nil
+}
+
+// fetchMissing fetches the chunks of the file we don't have from the node on
+// the other end of the peer with the address. It returns their indexes, and
+// the stream they are sent in.
+func (s *FileServer) fetchMissing(from string, chunks []ChunkRef) ([]int, io.ReadCloser, error) {
+	peer, ok := s.peer(from)
+	if !ok {
+		return nil, nil, fmt.Errorf("peer not found: %s", from)
+	}
+
+	missing := s.missingChunks(chunkHashes(chunks))
+	body, err := s.fetchChunks(peer, chunks, missing)
+	return missing, body, err
+}
+
+func (s *FileServer) handleMessageHaveChunks(from string, requestID uint64, msg MessageHaveChunks) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer not found: %s", from)
+	}
+
+	resp := Message{
+		RequestID: requestID,
+		Payload:   MessageWantChunks{Missing: s.missingChunks(msg.Hashes)},
+	}
+	return s.send(peer, &resp)
+}
+
+func (s *FileServer) handleMessageGetChunks(from string, requestID uint64, msg MessageGetChunks) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer not found: %s", from)
+	}
+
+	chunks := replicaChunks{store: s.store}
+	indexes := make([]int, len(msg.Hashes))
+	for i, hash := range msg.Hashes {
+		if !s.store.HasChunk(hash) {
+			resp := Message{
+				RequestID: requestID,
+				Payload:   MessageGetChunksResponse{Found: false},
+			}
+			return s.send(peer, &resp)
+		}
+
+		// The size of the stream has to be known up front.
+		size, err := s.store.chunkSize(hash)
+		if err != nil {
+			return err
+		}
+		chunks.Chunks = append(chunks.Chunks, ChunkRef{Hash: hash, Size: size})
+		indexes[i] = i
+	}
+
+	resp := Message{
+		RequestID: requestID,
+		Payload: MessageGetChunksResponse{
+			Found: true,
+			Size:  chunks.size(indexes),
+		},
+	}
+	_, err := s.sendStream(peer, &resp, chunks.reader(indexes))
+	return err
+}
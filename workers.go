@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io"
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+const (
+	defaultWorkers   = 32
+	defaultQueueSize = 1024
+	// The pings are handled by a pool of their own, so they are never held
+	// up behind the files, but a peer can only have a few of them at once.
+	defaultProbeWorkers   = 8
+	defaultProbeQueueSize = 4
+)
+
+// workerPool runs the jobs it is handed on a bounded number of goroutines.
+// The jobs with the same key run one after another, in the order they were
+// submitted, the jobs without a key run whenever a worker is free. Every peer
+// may only have a bounded number of jobs queued or running, the next job of a
+// peer that has that many waits until one of them is done.
+type workerPool struct {
+	// name prefixes what is logged about the jobs that panicked.
+	name string
+	// perPeer bounds the number of jobs of a peer that are queued or
+	// running, and workers the number of jobs that are running.
+	perPeer int
+	workers chan struct{}
+
+	lock sync.Mutex
+	cond *sync.Cond
+	// queues holds the jobs that wait on the job with the same key that is
+	// running. A key is in here as long as one of its jobs is running.
+	queues map[string][]func()
+	// pending holds the number of jobs of every peer that are queued or
+	// running, by the address of the peer.
+	pending map[string]int
+}
+
+func newWorkerPool(name string, workers int, perPeer int) *workerPool {
+	p := &workerPool{
+		name:    name,
+		perPeer: perPeer,
+		workers: make(chan struct{}, workers),
+		queues:  make(map[string][]func()),
+		pending: make(map[string]int),
+	}
+	p.cond = sync.NewCond(&p.lock)
+	return p
+}
+
+// submit hands the job of the peer over to the pool. It blocks while the peer
+// has too many jobs queued or running, which pushes back on the peer.
+func (p *workerPool) submit(peer string, key string, job func()) {
+	p.lock.Lock()
+	for p.pending[peer] >= p.perPeer {
+		p.cond.Wait()
+	}
+	p.enqueue(peer, key, job)
+}
+
+// trySubmit is submit, which returns false instead of blocking.
+func (p *workerPool) trySubmit(peer string, key string, job func()) bool {
+	p.lock.Lock()
+	if p.pending[peer] >= p.perPeer {
+		p.lock.Unlock()
+		return false
+	}
+	p.enqueue(peer, key, job)
+	return true
+}
+
+// enqueue queues the job, or runs it right away without a key. It must be
+// called with the lock held, which it releases.
+func (p *workerPool) enqueue(peer string, key string, job func()) {
+	p.pending[peer]++
+
+	job = p.done(peer, job)
+	if len(key) == 0 {
+		p.lock.Unlock()
+		go p.run(job)
+		return
+	}
+
+	queue, busy := p.queues[key]
+	p.queues[key] = append(queue, job)
+	p.lock.Unlock()
+
+	if !busy {
+		go p.drain(key)
+	}
+}
+
+// done returns the job, which makes room for another job of the peer once it
+// returned.
+func (p *workerPool) done(peer string, job func()) func() {
+	return func() {
+		defer func() {
+			p.lock.Lock()
+			if p.pending[peer]--; p.pending[peer] == 0 {
+				delete(p.pending, peer)
+			}
+			p.cond.Broadcast()
+			p.lock.Unlock()
+		}()
+
+		job()
+	}
+}
+
+// drain runs the jobs queued under the key until there are none left.
+func (p *workerPool) drain(key string) {
+	for {
+		p.lock.Lock()
+		queue := p.queues[key]
+		if len(queue) == 0 {
+			delete(p.queues, key)
+			p.lock.Unlock()
+			return
+		}
+		job := queue[0]
+		p.queues[key] = queue[1:]
+		p.lock.Unlock()
+
+		p.run(job)
+	}
+}
+
+// run runs the job once a worker is free. A job that panics is logged, and
+// doesn't take the node down with it.
+func (p *workerPool) run(job func()) {
+	p.workers <- struct{}{}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[%s] recovered from a panic in a message handler: %v\n%s", p.name, r, debug.Stack())
+		}
+		<-p.workers
+	}()
+
+	job()
+}
+
+// dispatch hands the message over to the workers, and accepts it once they
+// took it on. While a peer has too many messages pending, its message waits
+// for room without holding up the messages of the other peers, and as the
+// transport only delivers the next message of the peer once this one is
+// accepted, the peer is pushed back on. Responses are handed over to the
+// pending requests right away. Pings are handled by workers of their own, so
+// a busy node isn't suspected to be dead. Messages about a file are handled
+// in the order the peer sent them, other messages of the same peer in the
+// order they were sent as well, except for the questions about chunks, which
+// only read the store.
+func (s *FileServer) dispatch(from string, body io.ReadCloser, msg *Message, accept func()) {
+	if isResponse(msg.Payload) {
+		accept()
+		if err := s.handleResponse(from, body, msg); err != nil {
+			log.Println("handle message error: ", err)
+		}
+		return
+	}
+
+	handle := func() {
+		// The body of a stream is closed when the handler is done with it,
+		// also when it panicked, so the peer stops sending it.
+		if body != nil {
+			defer body.Close()
+		}
+		if err := s.handleMessage(from, body, msg); err != nil {
+			log.Println("handle message error: ", err)
+		}
+	}
+
+	pool, key := s.workers, from
+	switch v := msg.Payload.(type) {
+	case MessagePing, MessagePingReq:
+		pool, key = s.probeWorkers, ""
+	case MessageHaveChunks, MessageGetChunks:
+		key = ""
+	case MessageStoreFile:
+		key = from + "/" + v.ID + "/" + v.Key
+	case MessageGetFile:
+		key = from + "/" + v.ID + "/" + v.Key
+	case MessageStatFile:
+		key = from + "/" + v.ID + "/" + v.Key
+	case MessageDeleteFile:
+		key = from + "/" + v.ID + "/" + v.Key
+	}
+
+	if pool.trySubmit(from, key, handle) {
+		accept()
+		return
+	}
+	go func() {
+		pool.submit(from, key, handle)
+		accept()
+	}()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool(t *testing.T) {
+	p := newWorkerPool("test", 2, 4)
+
+	// A job that panics doesn't take the pool down with it.
+	done := make(chan struct{})
+	p.submit("peer", "", func() { panic("boom") })
+	p.submit("peer", "", func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting on the job after the panic")
+	}
+
+	// The jobs with the same key run in order, and never more jobs than
+	// there are workers run at once.
+	var (
+		lock    sync.Mutex
+		order   []int
+		running atomic.Int32
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		job := func() {
+			defer wg.Done()
+
+			if n := running.Add(1); n > 2 {
+				t.Errorf("expected at most 2 jobs at once, got %d", n)
+			}
+			defer running.Add(-1)
+
+			lock.Lock()
+			order = append(order, i)
+			lock.Unlock()
+		}
+		// The peer may only have 4 jobs at once, submit waits for room.
+		p.submit("peer", "peer", job)
+	}
+	wg.Wait()
+
+	for i, n := range order {
+		if i != n {
+			t.Fatalf("expected the jobs in order, got %v", order)
+		}
+	}
+
+	// Once a peer has too many jobs, its next job waits, without holding up
+	// the jobs of the other peers.
+	release := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		p.submit("peer", "", func() { <-release })
+	}
+	if p.trySubmit("peer", "", func() {}) {
+		t.Fatal("expected no room for the job while the peer has too many")
+	}
+
+	submitted := make(chan struct{})
+	go func() {
+		p.submit("peer", "", func() {})
+		close(submitted)
+	}()
+
+	if !p.trySubmit("other", "", func() {}) {
+		t.Fatal("expected room for the job of the other peer")
+	}
+
+	select {
+	case <-submitted:
+		t.Fatal("expected submit to wait while the peer has too many jobs")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-submitted:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting on submit")
+	}
+}